@@ -0,0 +1,52 @@
+package plugin
+
+import (
+	"fmt"
+	"net"
+)
+
+// AccessConfig restricts the client IPs that may open SSTP sessions
+type AccessConfig struct {
+	// If not empty, only clients in these networks are allowed
+	Allow []string `json:"allow,omitempty"`
+	// Clients in these networks are denied, even if they are allowed
+	Deny []string `json:"deny,omitempty"`
+	// If true, denied requests get 403 Forbidden, rather than being passed to the next handler
+	Forbid bool `json:"forbid,omitempty"`
+}
+
+// accessRules are the parsed networks of an AccessConfig
+type accessRules struct {
+	allow  []*net.IPNet
+	deny   []*net.IPNet
+	forbid bool
+}
+
+// Reason a request is denied by accessRules, used as the reason label of sstp_rejected_requests_total
+const rejectAccessDenied = "access_denied"
+
+func newAccessRules(c *AccessConfig) (accessRules, error) {
+	if c == nil {
+		return accessRules{}, nil
+	}
+	allow, err := parseCIDRs(c.Allow)
+	if err != nil {
+		return accessRules{}, fmt.Errorf("allow: invalid network: %s", err)
+	}
+	deny, err := parseCIDRs(c.Deny)
+	if err != nil {
+		return accessRules{}, fmt.Errorf("deny: invalid network: %s", err)
+	}
+	return accessRules{allow: allow, deny: deny, forbid: c.Forbid}, nil
+}
+
+// allowed returns true if a client with the IP address ip may open a session
+func (a accessRules) allowed(ip net.IP) bool {
+	if ip == nil {
+		return len(a.allow) == 0 && len(a.deny) == 0
+	}
+	if containsIP(a.deny, ip) {
+		return false
+	}
+	return len(a.allow) == 0 || containsIP(a.allow, ip)
+}
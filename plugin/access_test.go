@@ -0,0 +1,50 @@
+package plugin
+
+import (
+	"net"
+	"testing"
+)
+
+func TestAccessRulesAllowed(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *AccessConfig
+		ip     string
+		want   bool
+	}{
+		{"no rules", nil, "192.0.2.1", true},
+		{"allowed", &AccessConfig{Allow: []string{"192.0.2.0/24"}}, "192.0.2.1", true},
+		{"not allowed", &AccessConfig{Allow: []string{"192.0.2.0/24"}}, "198.51.100.1", false},
+		{"denied", &AccessConfig{Deny: []string{"192.0.2.0/24"}}, "192.0.2.1", false},
+		{"not denied", &AccessConfig{Deny: []string{"192.0.2.0/24"}}, "198.51.100.1", true},
+		{"deny takes precedence", &AccessConfig{Allow: []string{"192.0.2.0/24"}, Deny: []string{"192.0.2.128/25"}}, "192.0.2.200", false},
+		{"deny takes precedence over wider allow", &AccessConfig{Allow: []string{"0.0.0.0/0"}, Deny: []string{"192.0.2.1"}}, "192.0.2.1", false},
+		{"allowed outside deny", &AccessConfig{Allow: []string{"192.0.2.0/24"}, Deny: []string{"192.0.2.128/25"}}, "192.0.2.1", true},
+		{"single IPv6 address", &AccessConfig{Deny: []string{"2001:db8::1"}}, "2001:db8::1", false},
+		{"IPv4-mapped IPv6", &AccessConfig{Deny: []string{"192.0.2.0/24"}}, "::ffff:192.0.2.1", false},
+		{"unknown address with rules", &AccessConfig{Deny: []string{"192.0.2.0/24"}}, "", false},
+		{"unknown address without rules", &AccessConfig{}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rules, err := newAccessRules(tt.config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := rules.allowed(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("allowed(%q) = %t, want %t", tt.ip, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestAccessRulesInvalid(t *testing.T) {
+	for _, c := range []*AccessConfig{
+		{Allow: []string{"192.0.2.0/33"}},
+		{Deny: []string{"not an address"}},
+	} {
+		if _, err := newAccessRules(c); err == nil {
+			t.Errorf("newAccessRules(%+v) accepted an invalid network", c)
+		}
+	}
+}
@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+)
+
+// AdminConfig is the JSON configuration of the admin endpoint
+type AdminConfig struct {
+	// The path the admin endpoint is served on
+	Path string `json:"path,omitempty"`
+	// The networks allowed to use the admin endpoint, defaults to loopback addresses
+	Allow []string `json:"allow,omitempty"`
+}
+
+// adminConfig configures the admin endpoint, which lists and disconnects sessions
+type adminConfig struct {
+	path  string       // If empty, the admin endpoint is disabled
+	allow []*net.IPNet // The networks allowed to use the admin endpoint
+}
+
+// defaultAdminAllow only allows the admin endpoint to be used from the local machine
+var defaultAdminAllow = []string{"127.0.0.0/8", "::1/128"}
+
+// parseCIDRs parses a list of CIDRs, or single IP addresses
+func parseCIDRs(values []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(values))
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, &net.ParseError{Type: "IP address", Text: v}
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 8 * net.IPv4len
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// containsIP returns true if any of the networks contain ip
+func containsIP(networks []*net.IPNet, ip net.IP) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// basePath returns the path of the session list, without a trailing slash
+func (a adminConfig) basePath() string {
+	return strings.TrimSuffix(a.path, "/")
+}
+
+// matches returns true if the request is for the admin endpoint, or a session under it
+func (a adminConfig) matches(r *http.Request) bool {
+	if a.path == "" {
+		return false
+	}
+	path := a.basePath()
+	return r.URL.Path == path || strings.HasPrefix(r.URL.Path, path+"/")
+}
+
+// serveAdmin serves the admin endpoint:
+//
+//	GET    <path>       lists the sessions
+//	GET    <path>/<id>  shows a session
+//	DELETE <path>/<id>  disconnects a session
+func (s *Server) serveAdmin(w http.ResponseWriter, r *http.Request) error {
+	host := remoteIP(r)
+	if !containsIP(s.admin.allow, net.ParseIP(host)) {
+		return caddyhttp.Error(http.StatusForbidden, errors.New("Admin endpoint not allowed from "+host))
+	}
+
+	id := strings.Trim(strings.TrimPrefix(r.URL.Path, s.admin.basePath()), "/")
+	if id == "" {
+		if r.Method != http.MethodGet {
+			return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("Method not allowed: "+r.Method))
+		}
+		return writeJSON(w, http.StatusOK, s.sessions.list())
+	}
+	if strings.Contains(id, "/") {
+		return caddyhttp.Error(http.StatusNotFound, errors.New("Session not found: "+id))
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		info, ok := s.sessions.get(id)
+		if !ok {
+			return caddyhttp.Error(http.StatusNotFound, errors.New("Session not found: "+id))
+		}
+		return writeJSON(w, http.StatusOK, info)
+	case http.MethodDelete:
+		if !s.sessions.disconnect(id) {
+			return caddyhttp.Error(http.StatusNotFound, errors.New("Session not found: "+id))
+		}
+		return writeJSON(w, http.StatusAccepted, map[string]string{"id": id, "status": "disconnecting"})
+	default:
+		return caddyhttp.Error(http.StatusMethodNotAllowed, errors.New("Method not allowed: "+r.Method))
+	}
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return caddyhttp.Error(http.StatusInternalServerError, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,31 @@
+package plugin
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestAdminMatches(t *testing.T) {
+	tests := []struct {
+		path    string
+		request string
+		want    bool
+	}{
+		{"/sstp-admin", "/sstp-admin", true},
+		{"/sstp-admin", "/sstp-admin/", true},
+		{"/sstp-admin", "/sstp-admin/abc", true},
+		{"/sstp-admin", "/sstp-adminx", false},
+		{"/sstp-admin", "/sstp-admin.json", false},
+		{"/sstp-admin", "/sstp", false},
+		{"/sstp-admin/", "/sstp-admin", true},
+		{"/sstp-admin/", "/sstp-admin/abc", true},
+		{"/sstp-admin/", "/sstp-adminx", false},
+		{"", "/sstp-admin", false},
+	}
+	for _, tt := range tests {
+		a := adminConfig{path: tt.path}
+		if got := a.matches(httptest.NewRequest("GET", tt.request, nil)); got != tt.want {
+			t.Errorf("adminConfig{path: %q}.matches(%q) = %t, want %t", tt.path, tt.request, got, tt.want)
+		}
+	}
+}
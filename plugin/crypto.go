@@ -0,0 +1,162 @@
+package plugin
+
+import (
+	"crypto/hmac"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+
+	"github.com/comp500/caddy-sstp/sstp"
+)
+
+// The hash protocols that the server offers in CryptoBindingReq
+const hashProtocolsSupported = sstp.HashProtocolSHA1 | sstp.HashProtocolSHA256
+
+// Errors returned by crypto binding verification
+var (
+	ErrCryptoBindingHashProtocol = errors.New("Unsupported CryptoBinding hash protocol")
+	ErrCryptoBindingNonce        = errors.New("CryptoBinding nonce does not match")
+	ErrCryptoBindingCertHash     = errors.New("CryptoBinding certificate hash does not match")
+	ErrCryptoBindingCertUnknown  = errors.New("Server certificate unknown, can't check CryptoBinding certificate hash")
+	ErrCryptoBindingCompoundMAC  = errors.New("CryptoBinding compound MAC does not match")
+	ErrCryptoBindingNoHLAK       = errors.New("PPP backend can't export the HLAK, can't check CryptoBinding compound MAC")
+)
+
+// certHashes are the hashes of the certificates the client may have seen in the TLS handshake, for each hash protocol.
+// There is more than one if the handshake was resumed, as the certificate isn't sent again.
+// If there are none, the certificate is unknown and crypto binding fails.
+// A nil certHashes means the check is disabled with cert_hash off.
+type certHashes map[sstp.HashProtocol][][32]byte
+
+// newCertHashes computes the hashes of DER encoded certificates for each supported hash protocol
+func newCertHashes(certs ...[]byte) (certHashes, error) {
+	hashes := certHashes{}
+	for _, der := range certs {
+		for _, hp := range []sstp.HashProtocol{sstp.HashProtocolSHA1, sstp.HashProtocolSHA256} {
+			hash, err := sstp.CertHash(hp, der)
+			if err != nil {
+				return nil, err
+			}
+			hashes[hp] = append(hashes[hp], hash)
+		}
+	}
+	return hashes, nil
+}
+
+// check returns an error unless hash is one of the certificate hashes for the hash protocol
+func (h certHashes) check(hp sstp.HashProtocol, hash [32]byte) error {
+	if h == nil {
+		return nil
+	}
+	expected := h[hp]
+	if len(expected) == 0 {
+		return ErrCryptoBindingCertUnknown
+	}
+	for _, e := range expected {
+		if hmac.Equal(hash[:], e[:]) {
+			return nil
+		}
+	}
+	return ErrCryptoBindingCertHash
+}
+
+// loadCertHashes computes the hashes of the first certificate in a PEM file
+func loadCertHashes(filename string) (certHashes, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		var block *pem.Block
+		block, data = pem.Decode(data)
+		if block == nil {
+			return nil, fmt.Errorf("No certificate found in %s", filename)
+		}
+		if block.Type == "CERTIFICATE" {
+			return newCertHashes(block.Bytes)
+		}
+	}
+}
+
+// parseCertHash parses a hex encoded certificate hash for a hash protocol
+func parseCertHash(hp sstp.HashProtocol, s string) ([32]byte, error) {
+	var hash [32]byte
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return hash, err
+	}
+	if hp.Hash() == nil || len(b) != hp.Hash()().Size() {
+		return hash, fmt.Errorf("Invalid %s certificate hash length %d", hp, len(b))
+	}
+	copy(hash[:], b)
+	return hash, nil
+}
+
+// CertHashConfig pins the certificate hashes used for crypto binding, e.g. when TLS is offloaded.
+// File is a PEM certificate, and SHA1 and SHA256 are hex encoded hashes, which override File.
+// Off disables the certificate hash check, which otherwise fails when the certificate isn't known.
+type CertHashConfig struct {
+	File   string `json:"file,omitempty"`
+	SHA1   string `json:"sha1,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Off    bool   `json:"off,omitempty"`
+}
+
+// hashes loads the pinned certificate hashes, returning nil if the check is disabled
+func (c *CertHashConfig) hashes() (certHashes, error) {
+	if c.Off {
+		if c.File != "" || c.SHA1 != "" || c.SHA256 != "" {
+			return nil, errors.New("Can't disable the check and pin a certificate or hashes")
+		}
+		return nil, nil
+	}
+	hashes := certHashes{}
+	if c.File != "" {
+		loaded, err := loadCertHashes(c.File)
+		if err != nil {
+			return nil, err
+		}
+		hashes = loaded
+	}
+	for hp, value := range map[sstp.HashProtocol]string{sstp.HashProtocolSHA1: c.SHA1, sstp.HashProtocolSHA256: c.SHA256} {
+		if value == "" {
+			continue
+		}
+		hash, err := parseCertHash(hp, value)
+		if err != nil {
+			return nil, err
+		}
+		hashes[hp] = [][32]byte{hash}
+	}
+	if len(hashes) == 0 {
+		return nil, errors.New("No certificate or hashes given")
+	}
+	return hashes, nil
+}
+
+// verifyCryptoBinding checks the hash protocol, nonce and certificate hash of the CryptoBinding attribute of a Call Connected.
+func verifyCryptoBinding(binding sstp.CryptoBinding, nonce [32]byte, hashes certHashes) error {
+	if binding.HashProtocol&hashProtocolsSupported != binding.HashProtocol || binding.HashProtocol.Hash() == nil {
+		return ErrCryptoBindingHashProtocol
+	}
+	if !hmac.Equal(binding.Nonce[:], nonce[:]) {
+		return ErrCryptoBindingNonce
+	}
+	return hashes.check(binding.HashProtocol, binding.CertHash)
+}
+
+// verifyCompoundMAC checks the Compound MAC of a Call Connected, keyed by the HLAK from PPP authentication.
+//
+// The packet is the full Call Connected packet, including the SSTP header.
+func verifyCompoundMAC(packet []byte, binding sstp.CryptoBinding, hlak []byte) error {
+	expectedMAC, err := sstp.ComputeCompoundMAC(binding.HashProtocol, hlak, packet)
+	if err != nil {
+		return err
+	}
+	if !hmac.Equal(binding.CompoundMAC[:], expectedMAC[:]) {
+		return ErrCryptoBindingCompoundMAC
+	}
+	return nil
+}
@@ -0,0 +1,109 @@
+package plugin
+
+import (
+	"context"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/comp500/caddy-sstp/sstp"
+)
+
+func TestVerifyCryptoBinding(t *testing.T) {
+	cert := []byte("certificate")
+	hashes, err := newCertHashes(cert)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nonce := [32]byte{1, 2, 3}
+	binding := sstp.CryptoBinding{HashProtocol: sstp.HashProtocolSHA256, Nonce: nonce, CertHash: hashes[sstp.HashProtocolSHA256][0]}
+	wrongCert := binding
+	wrongCert.CertHash[0] ^= 0xff
+	wrongNonce := binding
+	wrongNonce.Nonce[0] ^= 0xff
+	bothProtocols := binding
+	bothProtocols.HashProtocol = sstp.HashProtocolSHA1 | sstp.HashProtocolSHA256
+
+	tests := []struct {
+		name    string
+		binding sstp.CryptoBinding
+		hashes  certHashes
+		err     error
+	}{
+		{"valid", binding, hashes, nil},
+		{"wrong certificate", wrongCert, hashes, ErrCryptoBindingCertHash},
+		{"wrong nonce", wrongNonce, hashes, ErrCryptoBindingNonce},
+		{"both hash protocols", bothProtocols, hashes, ErrCryptoBindingHashProtocol},
+		{"unknown certificate", binding, certHashes{}, ErrCryptoBindingCertUnknown},
+		{"check disabled", wrongCert, nil, nil},
+		{"check disabled, wrong nonce", wrongNonce, nil, ErrCryptoBindingNonce},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := verifyCryptoBinding(tt.binding, nonce, tt.hashes)
+			if err != tt.err {
+				t.Errorf("verifyCryptoBinding() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestCertHashOff(t *testing.T) {
+	var s Server
+	err := s.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`sstp {
+		cert_hash off
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s.CertHash == nil || !s.CertHash.Off {
+		t.Fatalf("CertHash = %+v, want Off", s.CertHash)
+	}
+	hashes, err := s.CertHash.hashes()
+	if err != nil || hashes != nil {
+		t.Errorf("hashes() = %v, %v, want nil", hashes, err)
+	}
+
+	pinned := CertHashConfig{Off: true, SHA256: "00"}
+	if _, err := pinned.hashes(); err == nil {
+		t.Error("hashes() with off and a pinned hash succeeded")
+	}
+}
+
+func TestCompoundMACOffRequiredForPppd(t *testing.T) {
+	var s Server
+	err := s.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`sstp {
+		backend pppd
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	if err := s.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Validate(); err == nil {
+		t.Error("Validate() accepted the pppd backend without compound_mac off")
+	}
+
+	err = s.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`sstp {
+		compound_mac off
+	}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !s.SkipCompoundMAC {
+		t.Fatal("compound_mac off not set")
+	}
+	if err := s.Validate(); err != nil {
+		t.Errorf("Validate() = %v", err)
+	}
+
+	err = s.UnmarshalCaddyfile(caddyfile.NewTestDispenser(`sstp {
+		compound_mac on
+	}`))
+	if err == nil {
+		t.Error("compound_mac accepted a value other than off")
+	}
+}
@@ -0,0 +1,48 @@
+package plugin
+
+import (
+	"sync/atomic"
+
+	"github.com/comp500/caddy-sstp/sstp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+// SetNonceSource replaces the generator of CryptoBindingReq nonces, until restore is called
+func SetNonceSource(f func() ([32]byte, error)) (restore func()) {
+	old := newNonce
+	newNonce = f
+	return func() { newNonce = old }
+}
+
+// CheckUpstreams runs a health check of the Server's upstreams, returning the addresses of the healthy ones
+func CheckUpstreams(s *Server) []string {
+	s.proxy.checkHealth()
+	var healthy []string
+	for _, u := range s.proxy.upstreams {
+		if u.healthy() {
+			healthy = append(healthy, u.addr)
+		}
+	}
+	return healthy
+}
+
+// UpstreamCertificateMismatches returns the addresses of the Server's upstreams serving a certificate clients don't bind to
+func UpstreamCertificateMismatches(s *Server) []string {
+	var mismatched []string
+	for _, u := range s.proxy.upstreams {
+		if atomic.LoadInt32(&u.certMismatch) != 0 {
+			mismatched = append(mismatched, u.addr)
+		}
+	}
+	return mismatched
+}
+
+// HandshakesTotal returns the sstp_handshakes_total counter for result
+func HandshakesTotal(result string) float64 {
+	return testutil.ToFloat64(metrics.handshakes.WithLabelValues(result))
+}
+
+// ControlMessagesReceived returns the sstp_control_messages_received_total counter for messageType
+func ControlMessagesReceived(messageType sstp.MessageType) float64 {
+	return testutil.ToFloat64(metrics.controlMessagesIn.WithLabelValues(messageType.String()))
+}
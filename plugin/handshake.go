@@ -0,0 +1,224 @@
+package plugin
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+
+	"github.com/comp500/caddy-sstp/sstp"
+)
+
+// The Content-Length value of SSTP handshakes, which is greater than an int64,
+// and the value it is replaced with so net/http can parse it, padded to the same length.
+const (
+	handshakeLengthOriginal = sstp.HandshakeContentLength
+	handshakeLengthReplaced = "9223372036854775807 " // max int64
+)
+
+// maxHandshakeLine is the longest request or header line the parser buffers.
+// Longer lines are passed through, and the connection is no longer parsed.
+const maxHandshakeLine = 64 << 10
+
+// parserState is the part of a HTTP/1.x request the handshakeParser is expecting
+type parserState int
+
+// Constants for parserState values
+const (
+	parserStateRequestLine parserState = iota
+	parserStateHeaders
+	parserStateBody
+	parserStateChunkSize
+	parserStateChunkData
+	parserStateChunkEnd
+	parserStateTrailers
+	parserStatePassthrough // The rest of the connection isn't HTTP/1.x requests, e.g. the SSTP stream
+)
+
+// handshakeParser follows the HTTP/1.x requests on a connection, and rewrites the Content-Length
+// of SSTP handshakes. It is fed bytes as they are read, which may split lines anywhere.
+//
+// Lines are held back until they are complete, so a header split across reads can still be rewritten.
+// Request bodies are skipped, so a SSTP handshake is found after earlier requests on a keep-alive connection.
+type handshakeParser struct {
+	state parserState
+	line  []byte // The incomplete line being held back
+	ready []byte // Bytes that have been parsed, and can be returned
+
+	// The request being parsed
+	isSSTP        bool
+	upgrade       bool
+	chunked       bool
+	contentLength int64
+	remaining     int64 // Bytes of the body, or the current chunk, left to pass through
+	rewritten     bool  // Set when a SSTP handshake has been rewritten
+}
+
+// passthrough returns true if the parser no longer looks at the connection
+func (p *handshakeParser) passthrough() bool {
+	return p.state == parserStatePassthrough
+}
+
+// bodyRemaining returns how many bytes can be passed through without parsing
+func (p *handshakeParser) bodyRemaining() int64 {
+	if p.state == parserStateBody || p.state == parserStateChunkData {
+		return p.remaining
+	}
+	return 0
+}
+
+// skipBody records that n bytes of the body or chunk were passed through without parsing
+func (p *handshakeParser) skipBody(n int) {
+	p.remaining -= int64(n)
+	if p.remaining == 0 {
+		p.endBody()
+	}
+}
+
+// feed parses data, adding it to the ready bytes once it has been parsed
+func (p *handshakeParser) feed(data []byte) {
+	for len(data) > 0 {
+		switch p.state {
+		case parserStatePassthrough:
+			p.ready = append(p.ready, data...)
+			return
+		case parserStateBody, parserStateChunkData:
+			n := len(data)
+			if int64(n) > p.remaining {
+				n = int(p.remaining)
+			}
+			p.ready = append(p.ready, data[:n]...)
+			data = data[n:]
+			p.skipBody(n)
+		default:
+			i := bytes.IndexByte(data, '\n')
+			if i < 0 {
+				p.line = append(p.line, data...)
+				if len(p.line) > maxHandshakeLine {
+					p.stop()
+				}
+				return
+			}
+			p.line = append(p.line, data[:i+1]...)
+			data = data[i+1:]
+			line := p.line
+			p.line = nil
+			p.parseLine(line)
+			p.ready = append(p.ready, line...)
+		}
+	}
+}
+
+// flush makes any held back bytes ready, when no more bytes will be read
+func (p *handshakeParser) flush() {
+	p.ready = append(p.ready, p.line...)
+	p.line = nil
+}
+
+// stop gives up parsing, and passes the rest of the connection through
+func (p *handshakeParser) stop() {
+	p.flush()
+	p.state = parserStatePassthrough
+}
+
+// parseLine parses a complete line, including its line ending. The line may be modified in place.
+func (p *handshakeParser) parseLine(line []byte) {
+	text := strings.TrimRight(string(line), "\r\n")
+	switch p.state {
+	case parserStateRequestLine:
+		if text == "" {
+			// Empty lines may be sent before a request
+			return
+		}
+		parts := strings.Split(text, " ")
+		if len(parts) != 3 || !strings.HasPrefix(parts[2], "HTTP/1.") {
+			// Not HTTP/1.x, e.g. the HTTP/2 preface
+			p.state = parserStatePassthrough
+			return
+		}
+		p.isSSTP = parts[0] == MethodSstp
+		p.upgrade = parts[0] == "CONNECT"
+		p.chunked = false
+		p.contentLength = 0
+		p.state = parserStateHeaders
+	case parserStateHeaders:
+		if text == "" {
+			p.endHeaders()
+			return
+		}
+		colon := strings.IndexByte(text, ':')
+		if colon < 0 {
+			// Continuation lines and invalid headers don't affect framing
+			return
+		}
+		name := strings.TrimSpace(text[:colon])
+		value := strings.TrimSpace(text[colon+1:])
+		switch {
+		case strings.EqualFold(name, "Content-Length"):
+			if p.isSSTP && value == handshakeLengthOriginal {
+				// Replace the value in place, so the length of the line is the same
+				start := colon + 1 + strings.Index(text[colon+1:], value)
+				copy(line[start:], handshakeLengthReplaced)
+				p.rewritten = true
+				return
+			}
+			length, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || length < 0 {
+				// net/http will reject the request, so there's nothing more to find
+				p.state = parserStatePassthrough
+				return
+			}
+			p.contentLength = length
+		case strings.EqualFold(name, "Transfer-Encoding"):
+			p.chunked = strings.Contains(strings.ToLower(value), "chunked")
+		case strings.EqualFold(name, "Upgrade"):
+			p.upgrade = true
+		}
+	case parserStateChunkSize:
+		size := text
+		if i := strings.IndexByte(size, ';'); i >= 0 {
+			size = size[:i]
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(size), 16, 64)
+		if err != nil || n < 0 {
+			p.state = parserStatePassthrough
+			return
+		}
+		if n == 0 {
+			p.state = parserStateTrailers
+			return
+		}
+		p.remaining = n
+		p.state = parserStateChunkData
+	case parserStateChunkEnd:
+		p.state = parserStateChunkSize
+	case parserStateTrailers:
+		if text == "" {
+			p.state = parserStateRequestLine
+		}
+	}
+}
+
+// endHeaders decides what follows the headers of a request
+func (p *handshakeParser) endHeaders() {
+	switch {
+	case p.isSSTP, p.upgrade:
+		// The rest of the connection is the SSTP stream, or another protocol
+		p.state = parserStatePassthrough
+	case p.chunked:
+		p.state = parserStateChunkSize
+	case p.contentLength > 0:
+		p.remaining = p.contentLength
+		p.state = parserStateBody
+	default:
+		p.state = parserStateRequestLine
+	}
+}
+
+// endBody moves on once a body or chunk has been passed through
+func (p *handshakeParser) endBody() {
+	if p.state == parserStateChunkData {
+		p.state = parserStateChunkEnd
+	} else {
+		p.state = parserStateRequestLine
+	}
+}
@@ -0,0 +1,145 @@
+package plugin
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+)
+
+const (
+	testHandshake  = "SSTP_DUPLEX_POST /sra_{BA195980-CD49-458b-9E23-C84EE0ADCD75}/ HTTP/1.1\r\nHost: sstp.test\r\nContent-Length: 18446744073709551615\r\n\r\n"
+	testRewritten  = "SSTP_DUPLEX_POST /sra_{BA195980-CD49-458b-9E23-C84EE0ADCD75}/ HTTP/1.1\r\nHost: sstp.test\r\nContent-Length: 9223372036854775807 \r\n\r\n"
+	testSSTPStream = "\x10\x01\x00\x0cContent-Length: 18446744073709551615\r\n"
+)
+
+var (
+	testFormRequest    = "POST /form HTTP/1.1\r\nHost: sstp.test\r\nContent-Length: 5\r\n\r\nhello"
+	testChunkedRequest = "POST /form HTTP/1.1\r\nTransfer-Encoding: chunked\r\n\r\n5\r\nhello\r\n0\r\n\r\n"
+	testLookalike      = "POST /form HTTP/1.1\r\nContent-Length: " + strconv.Itoa(len(testHandshake)) + "\r\n\r\n" + testHandshake
+	testOtherMethod    = strings.Replace(testHandshake, "SSTP_DUPLEX_POST", "POST", 1)
+	testHTTP2Preface   = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+)
+
+var handshakeParserTests = []struct {
+	name string
+	in   string
+	want string
+}{
+	{"handshake", testHandshake, testRewritten},
+	{"SSTP stream is passed through", testHandshake + testSSTPStream, testRewritten + testSSTPStream},
+	{"lower case method", strings.ToLower(testHandshake[:4]) + testHandshake[4:], strings.ToLower(testHandshake[:4]) + testHandshake[4:]},
+	{"header name case", strings.Replace(testHandshake, "Content-Length", "content-length", 1), strings.Replace(testRewritten, "Content-Length", "content-length", 1)},
+	{"after request with body", testFormRequest + testHandshake, testFormRequest + testRewritten},
+	{"after chunked request", testChunkedRequest + testHandshake, testChunkedRequest + testRewritten},
+	{"body that looks like a handshake", testLookalike, testLookalike},
+	{"other method", testOtherMethod, testOtherMethod},
+	{"HTTP/2 preface", testHTTP2Preface + testHandshake, testHTTP2Preface + testHandshake},
+}
+
+// parseAll feeds in to a new handshakeParser in pieces of the given sizes, returning everything it makes ready
+func parseAll(in string, sizes ...int) string {
+	var p handshakeParser
+	data := []byte(in)
+	for _, size := range sizes {
+		if size > len(data) {
+			size = len(data)
+		}
+		p.feed(append([]byte(nil), data[:size]...))
+		data = data[size:]
+	}
+	p.feed(data)
+	p.flush()
+	return string(p.ready)
+}
+
+func TestHandshakeParserSplitReads(t *testing.T) {
+	for _, tt := range handshakeParserTests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Split in two at every offset
+			for i := 0; i <= len(tt.in); i++ {
+				if got := parseAll(tt.in, i); got != tt.want {
+					t.Fatalf("Split at %d: got %q, want %q", i, got, tt.want)
+				}
+			}
+			// One byte at a time
+			sizes := make([]int, len(tt.in))
+			for i := range sizes {
+				sizes[i] = 1
+			}
+			if got := parseAll(tt.in, sizes...); got != tt.want {
+				t.Fatalf("Byte at a time: got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// chunkedConn is a net.Conn that returns at most size bytes per Read
+type chunkedConn struct {
+	net.Conn
+	r    io.Reader
+	size int
+}
+
+func (c *chunkedConn) Read(b []byte) (int, error) {
+	if len(b) > c.size {
+		b = b[:c.size]
+	}
+	return c.r.Read(b)
+}
+
+func TestWrappedConnSplitReads(t *testing.T) {
+	for _, tt := range handshakeParserTests {
+		for _, size := range []int{1, 7, 64, 4096} {
+			c := &chunkedConn{r: strings.NewReader(tt.in), size: size}
+			conn := &WrappedConn{Conn: c, remoteAddr: &net.TCPAddr{}, log: zap.NewNop()}
+			got, err := io.ReadAll(conn)
+			if err != nil {
+				t.Fatalf("%s: %s", tt.name, err)
+			}
+			if string(got) != tt.want {
+				t.Errorf("%s, %d byte reads: got %q, want %q", tt.name, size, got, tt.want)
+			}
+		}
+	}
+}
+
+// timeoutConn is a net.Conn whose reads time out once, after the first Read
+type timeoutConn struct {
+	net.Conn
+	r        io.Reader
+	timedOut bool
+}
+
+func (c *timeoutConn) Read(b []byte) (int, error) {
+	if len(b) > 10 {
+		b = b[:10]
+	}
+	n, err := c.r.Read(b)
+	if !c.timedOut {
+		c.timedOut = true
+		return n, os.ErrDeadlineExceeded
+	}
+	return n, err
+}
+
+func TestWrappedConnTimeout(t *testing.T) {
+	conn := &WrappedConn{Conn: &timeoutConn{r: strings.NewReader(testHandshake)}, remoteAddr: &net.TCPAddr{}, log: zap.NewNop()}
+	// The first bytes are held back as their line is incomplete
+	if _, err := conn.Read(make([]byte, 64)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("Read() error = %v, want %v", err, os.ErrDeadlineExceeded)
+	}
+	// but the connection can still be read, e.g. after net/http aborts a background read
+	got, err := io.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != testRewritten {
+		t.Errorf("got %q, want %q", got, testRewritten)
+	}
+}
@@ -0,0 +1,138 @@
+package plugin
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+// LimitsConfig limits the SSTP sessions a Server accepts. Zero values are unlimited.
+type LimitsConfig struct {
+	// The maximum number of concurrent sessions
+	MaxSessions int `json:"max_sessions,omitempty"`
+	// The maximum number of concurrent sessions from a single client IP
+	MaxSessionsPerIP int `json:"max_sessions_per_ip,omitempty"`
+	// The number of handshakes a single client IP may make per HandshakeInterval
+	HandshakeRate     int            `json:"handshake_rate,omitempty"`
+	HandshakeInterval caddy.Duration `json:"handshake_interval,omitempty"`
+}
+
+// DefaultHandshakeInterval is the interval of the handshake rate limit, if it isn't configured
+const DefaultHandshakeInterval = time.Minute
+
+// Reasons a request is rejected by the sessionLimiter, used as the reason label of sstp_rejected_requests_total
+const (
+	rejectMaxSessions      = "max_sessions"
+	rejectMaxSessionsPerIP = "max_sessions_per_ip"
+	rejectHandshakeRate    = "handshake_rate"
+)
+
+// rejectStatus is the HTTP status sent for each rejection reason
+var rejectStatus = map[string]int{
+	rejectMaxSessions:      http.StatusServiceUnavailable,
+	rejectMaxSessionsPerIP: http.StatusTooManyRequests,
+	rejectHandshakeRate:    http.StatusTooManyRequests,
+}
+
+// tokenBucket allows a burst of handshakes, refilled at a steady rate
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+// sessionLimiter enforces a Server's LimitsConfig.
+// Sessions are reserved before the connection is hijacked, and released when the session finishes.
+type sessionLimiter struct {
+	lock     sync.Mutex
+	maxTotal int
+	maxPerIP int
+	rate     int
+	interval time.Duration
+
+	total   int
+	perIP   map[string]int
+	buckets map[string]*tokenBucket
+	pruned  time.Time
+}
+
+func newSessionLimiter(c *LimitsConfig) *sessionLimiter {
+	l := &sessionLimiter{perIP: make(map[string]int), buckets: make(map[string]*tokenBucket)}
+	if c != nil {
+		l.maxTotal = c.MaxSessions
+		l.maxPerIP = c.MaxSessionsPerIP
+		l.rate = c.HandshakeRate
+		l.interval = durationOrDefault(time.Duration(c.HandshakeInterval), DefaultHandshakeInterval)
+	}
+	return l
+}
+
+// acquire reserves a session for ip. If a limit is reached, it returns the reason,
+// and how long the client should wait before retrying, if known.
+func (l *sessionLimiter) acquire(ip string, now time.Time) (string, time.Duration) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.maxTotal > 0 && l.total >= l.maxTotal {
+		return rejectMaxSessions, 0
+	}
+	if l.maxPerIP > 0 && l.perIP[ip] >= l.maxPerIP {
+		return rejectMaxSessionsPerIP, 0
+	}
+	if l.rate > 0 {
+		l.prune(now)
+		perToken := l.interval / time.Duration(l.rate)
+		bucket, ok := l.buckets[ip]
+		if !ok {
+			bucket = &tokenBucket{tokens: float64(l.rate), updated: now}
+			l.buckets[ip] = bucket
+		}
+		bucket.tokens = math.Min(float64(l.rate), bucket.tokens+float64(now.Sub(bucket.updated))/float64(perToken))
+		bucket.updated = now
+		if bucket.tokens < 1 {
+			return rejectHandshakeRate, time.Duration((1 - bucket.tokens) * float64(perToken))
+		}
+		bucket.tokens--
+	}
+
+	l.total++
+	l.perIP[ip]++
+	return "", 0
+}
+
+// release frees a session reserved by acquire
+func (l *sessionLimiter) release(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.total--
+	if l.perIP[ip] <= 1 {
+		delete(l.perIP, ip)
+	} else {
+		l.perIP[ip]--
+	}
+}
+
+// prune forgets the buckets that have refilled, at most once per interval
+func (l *sessionLimiter) prune(now time.Time) {
+	if now.Sub(l.pruned) < l.interval {
+		return
+	}
+	l.pruned = now
+	for ip, bucket := range l.buckets {
+		if now.Sub(bucket.updated) >= l.interval {
+			delete(l.buckets, ip)
+		}
+	}
+}
+
+// remoteIP returns the IP address of the client that sent r, without the port
+func remoteIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,76 @@
+package plugin
+
+import (
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+)
+
+func TestSessionLimiterConcurrent(t *testing.T) {
+	l := newSessionLimiter(&LimitsConfig{MaxSessions: 3, MaxSessionsPerIP: 2})
+	now := time.Now()
+	steps := []struct {
+		ip   string
+		want string
+	}{
+		{"192.0.2.1", ""},
+		{"192.0.2.1", ""},
+		{"192.0.2.1", rejectMaxSessionsPerIP},
+		{"192.0.2.2", ""},
+		{"192.0.2.3", rejectMaxSessions},
+	}
+	for i, step := range steps {
+		if reason, _ := l.acquire(step.ip, now); reason != step.want {
+			t.Fatalf("Step %d: acquire(%s) = %q, want %q", i, step.ip, reason, step.want)
+		}
+	}
+
+	l.release("192.0.2.1")
+	if reason, _ := l.acquire("192.0.2.3", now); reason != "" {
+		t.Errorf("acquire() after release = %q, want a session", reason)
+	}
+	if reason, _ := l.acquire("192.0.2.1", now); reason != rejectMaxSessions {
+		t.Errorf("acquire() = %q, want %q", reason, rejectMaxSessions)
+	}
+}
+
+func TestSessionLimiterHandshakeRate(t *testing.T) {
+	l := newSessionLimiter(&LimitsConfig{HandshakeRate: 2, HandshakeInterval: caddy.Duration(time.Minute)})
+	now := time.Now()
+	for i := 0; i < 2; i++ {
+		if reason, _ := l.acquire("192.0.2.1", now); reason != "" {
+			t.Fatalf("Handshake %d rejected: %s", i, reason)
+		}
+		l.release("192.0.2.1")
+	}
+
+	reason, retryAfter := l.acquire("192.0.2.1", now)
+	if reason != rejectHandshakeRate {
+		t.Fatalf("acquire() = %q, want %q", reason, rejectHandshakeRate)
+	}
+	if retryAfter != 30*time.Second {
+		t.Errorf("Retry after %s, want 30s", retryAfter)
+	}
+	// Other clients have their own bucket
+	if reason, _ := l.acquire("192.0.2.2", now); reason != "" {
+		t.Errorf("Other client rejected: %s", reason)
+	}
+	// One token is refilled every interval / rate
+	if reason, _ := l.acquire("192.0.2.1", now.Add(30*time.Second)); reason != "" {
+		t.Errorf("Handshake rejected after refill: %s", reason)
+	}
+}
+
+func TestRejectStatus(t *testing.T) {
+	tests := map[string]int{
+		rejectMaxSessions:      503,
+		rejectMaxSessionsPerIP: 429,
+		rejectHandshakeRate:    429,
+	}
+	for reason, want := range tests {
+		if got := rejectStatus[reason]; got != want {
+			t.Errorf("rejectStatus[%s] = %d, want %d", reason, got, want)
+		}
+	}
+}
@@ -1,127 +1,279 @@
 package plugin
 
 import (
-	"bytes"
+	"context"
+	"crypto/tls"
 	"errors"
-	"log"
 	"net"
+	"sync"
+	"time"
 
-	"github.com/caddyserver/caddy"
+	"github.com/caddyserver/caddy/v2"
+	"go.uber.org/zap"
 )
 
-// Listener is a wrapper around a caddy.Listener that modifies SSTP requests.
+// ListenerWrapper is a Caddy listener wrapper (caddy.listeners.sstp) that modifies SSTP handshakes,
+// so they can be parsed by net/http.
+//
+// It must come after the tls listener wrapper, so it sees the decrypted request:
+//
+//	listener_wrappers {
+//		tls
+//		sstp
+//	}
+//
+// Wrapped TLS connections implement ConnectionState, so net/http still sets r.TLS for every site.
+// This needs Go 1.27 or later, which also records the certificate served to the client for crypto binding.
+// Connections that negotiate HTTP/2 are wrapped without being parsed, as SSTP is only sent over HTTP/1.1.
+//
+// If ProxyProtocol is set, the PROXY protocol header is read from the underlying connection
+// before the TLS handshake, and the client address it gives is the wrapped connection's RemoteAddr,
+// for HTTP/1.1 and HTTP/2 connections alike.
+type ListenerWrapper struct {
+	// How long to wait for the TLS handshake, defaults to DefaultTLSHandshakeTimeout
+	HandshakeTimeout caddy.Duration `json:"handshake_timeout,omitempty"`
+	// The minimum level of messages logged, in addition to the level of Caddy's log
+	LogLevel string `json:"log_level,omitempty"`
+	// Reads the client address from PROXY protocol headers sent by trusted load balancers
+	ProxyProtocol *ProxyProtocolConfig `json:"proxy_protocol,omitempty"`
+
+	log          *zap.Logger
+	proxyTrusted []*net.IPNet
+}
+
+// DefaultTLSHandshakeTimeout is how long the Listener waits for a client to complete the TLS handshake.
+const DefaultTLSHandshakeTimeout = 10 * time.Second
+
+// WrapListener wraps ln in a Listener. See caddy.ListenerWrapper.
+func (lw *ListenerWrapper) WrapListener(ln net.Listener) net.Listener {
+	return &Listener{
+		Listener:         ln,
+		log:              lw.log,
+		proxyTrusted:     lw.proxyTrusted,
+		handshakeTimeout: durationOrDefault(time.Duration(lw.HandshakeTimeout), DefaultTLSHandshakeTimeout),
+		conns:            make(chan net.Conn),
+		errs:             make(chan error),
+		closed:           make(chan struct{}),
+	}
+}
+
+// Listener is a wrapper around a net.Listener that modifies SSTP requests.
+//
+// TLS handshakes are done before connections are returned by Accept, so the negotiated protocol is known.
+// They are done concurrently, along with reading PROXY protocol headers, so a slow client doesn't hold up the others.
 type Listener struct {
-	caddy.Listener
+	net.Listener
+	handshakeTimeout time.Duration
+	proxyTrusted     []*net.IPNet // The networks trusted to send PROXY protocol headers
+	log              *zap.Logger
+
+	conns     chan net.Conn
+	errs      chan error
+	startOnce sync.Once
+	closeOnce sync.Once
+	closed    chan struct{}
 }
 
 // WrappedConn is a wrapper around a net.Conn that modifies SSTP requests.
 type WrappedConn struct {
 	net.Conn
-	ignoreFurther   bool
-	checkedMethod   bool
-	currentOffset   int
-	handshakeBuffer bytes.Buffer
+	parser      handshakeParser
+	buf         []byte   // Read into before parsing
+	readErr     error    // Returned once the parsed bytes have been read
+	remoteAddr  net.Addr // The client address from the PROXY protocol, if any
+	serverCerts [][]byte // The leaf certificates the client may have been served in the TLS handshake
+	log         *zap.Logger
+}
+
+// WrappedTLSConn is a WrappedConn over a TLS connection.
+// It implements ConnectionState, so net/http sets r.TLS for its requests.
+type WrappedTLSConn struct {
+	*WrappedConn
+	tlsConn *tls.Conn
 }
 
-// Accept is a wrapper around caddy.Listener.Accept() that intercepts the SSTP HTTP handshake.
+// Accept returns the next connection, once its TLS handshake is done.
 func (l *Listener) Accept() (net.Conn, error) {
-	c, err := l.Listener.Accept()
-	if err != nil {
+	l.startOnce.Do(func() { go l.acceptLoop() })
+	select {
+	case c := <-l.conns:
+		return c, nil
+	case err := <-l.errs:
 		return nil, err
+	case <-l.closed:
+		return nil, net.ErrClosed
 	}
+}
 
-	return &WrappedConn{Conn: c}, nil
+// Close closes the listener, and any connections not yet returned by Accept.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() { close(l.closed) })
+	return l.Listener.Close()
 }
 
-// The string to find and replace within SSTP handshakes.
-const (
-	HandshakeLengthOriginal = "Content-Length: 18446744073709551615"
-	HandshakeLengthReplaced = "Content-Length: 9223372036854775807 "
-)
+func (l *Listener) acceptLoop() {
+	for {
+		c, err := l.Listener.Accept()
+		if err != nil {
+			select {
+			case l.errs <- err:
+			case <-l.closed:
+				return
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
 
-// The string to verify from the start of the request, to check that it is a SSTP handshake.
-const (
-	MethodCheckString = "SSTP"
-	MethodCheckLen    = len(MethodCheckString)
-)
+		go l.prepare(c)
+	}
+}
+
+// prepare reads the PROXY protocol header and completes the TLS handshake, then delivers the connection to Accept
+func (l *Listener) prepare(c net.Conn) {
+	tlsConn, isTLS := c.(*tls.Conn)
+	raw := c
+	if isTLS {
+		// The TLS handshake hasn't started, so the header is still unread on the underlying connection
+		raw = tlsConn.NetConn()
+	}
+
+	var remoteAddr net.Addr
+	if l.trustsProxy(raw.RemoteAddr()) {
+		raw.SetReadDeadline(time.Now().Add(l.handshakeTimeout))
+		addr, err := readProxyHeader(raw)
+		raw.SetReadDeadline(time.Time{})
+		if err != nil {
+			l.log.Warn("Failed to read PROXY protocol header", zap.Stringer("remote", raw.RemoteAddr()), zap.Error(err))
+			c.Close()
+			return
+		}
+		remoteAddr = addr
+		l.log.Debug("PROXY protocol header received", zap.Stringer("remote", raw.RemoteAddr()), zap.Stringer("client", remoteAddr))
+	}
+
+	if !isTLS {
+		l.deliver(&WrappedConn{Conn: c, remoteAddr: remoteAddr, log: l.log})
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), l.handshakeTimeout)
+	defer cancel()
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		l.log.Debug("TLS handshake failed", zap.Stringer("remote", c.RemoteAddr()), zap.Error(err))
+		c.Close()
+		return
+	}
+	// SSTP is never sent over HTTP/2, but the connection is still wrapped so it has the PROXY protocol address.
+	// net/http serves HTTP/2 on any connection that implements ConnectionState.
+	state := tlsConn.ConnectionState()
+	if state.NegotiatedProtocol == "h2" {
+		wrapped := &WrappedConn{Conn: c, parser: handshakeParser{state: parserStatePassthrough}, remoteAddr: remoteAddr, log: l.log}
+		l.deliver(&WrappedTLSConn{WrappedConn: wrapped, tlsConn: tlsConn})
+		return
+	}
+	wrapped := &WrappedConn{Conn: c, remoteAddr: remoteAddr, serverCerts: servedCertificates.handshake(state, time.Now()), log: l.log}
+	l.deliver(&WrappedTLSConn{WrappedConn: wrapped, tlsConn: tlsConn})
+}
+
+// trustsProxy returns true if addr is trusted to send a PROXY protocol header
+func (l *Listener) trustsProxy(addr net.Addr) bool {
+	if len(l.proxyTrusted) == 0 {
+		return false
+	}
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	return ok && containsIP(l.proxyTrusted, tcpAddr.IP)
+}
+
+func (l *Listener) deliver(c net.Conn) {
+	select {
+	case l.conns <- c:
+	case <-l.closed:
+		c.Close()
+	}
+}
+
+// RemoteAddr returns the client address given by the PROXY protocol, or the connection's remote address.
+func (c *WrappedConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// ServerCertificates returns the DER encoded leaf certificates the client may have been served in the TLS handshake.
+// A full handshake has one, and a resumed handshake has those recently served for the same server name.
+// It returns nil if the certificate is unknown.
+func (c *WrappedConn) ServerCertificates() [][]byte {
+	return c.serverCerts
+}
+
+// ConnectionState returns the state of the TLS connection.
+func (c *WrappedTLSConn) ConnectionState() tls.ConnectionState {
+	return c.tlsConn.ConnectionState()
+}
 
 // Overrides net.Conn.Read to modify SSTP requests.
 //
 // This is needed as SSTP handshakes use a Content-Length greater than an int64, so it must be modified to be compatible.
 //
-// This currently only works on HTTP requests, as we currently have no way intercept after SSL decryption.
+// On HTTPS sites, this only works if the Listener wraps the tls listener wrapper, so the request is decrypted.
 //
-// This function is passive: it will not read more bytes than c.Conn.Read reads, and will modify them if it is needed.
+// Requests are parsed as they are read, and bytes are only returned once their line is complete,
+// so the Content-Length can be rewritten wherever the reads are split.
 func (c *WrappedConn) Read(b []byte) (int, error) {
-	// TODO: use buffer pools
-	if c.ignoreFurther {
-		return c.Conn.Read(b)
+	if len(b) == 0 {
+		return 0, nil
 	}
-
-	n, err := c.Conn.Read(b)
-	if err != nil {
-		return n, err
-	}
-	log.Printf("Read %v bytes", n)
-
-	// Check the method
-	if !c.checkedMethod {
-		if c.currentOffset == 0 {
-			if len(b) >= MethodCheckLen {
-				// If not SSTP, ignore further bytes and passthrough
-				if !bytes.Equal(b[:MethodCheckLen], []byte(MethodCheckString)) {
-					c.ignoreFurther = true
-					return n, nil
-				}
-				c.checkedMethod = true
-			} else {
-				// Return with current data, wait for more
-				c.handshakeBuffer.Write(b)
-				c.currentOffset += len(b)
-				return n, nil
-			}
-		} else {
-			c.handshakeBuffer.Write(b)
-			if c.handshakeBuffer.Len() < MethodCheckLen {
-				// Return with current data, wait for more
-				c.currentOffset += c.handshakeBuffer.Len()
-				return n, nil
-			}
-			checkSlice := make([]byte, MethodCheckLen)
-			numChecked, err := c.handshakeBuffer.Read(checkSlice)
-			if err != nil {
-				return n, err
-			}
-			if numChecked != MethodCheckLen {
-				// This shouldn't happen
-				return n, errors.New("Internal sstp WrappedConn error")
+	p := &c.parser
+	for {
+		if len(p.ready) > 0 {
+			n := copy(b, p.ready)
+			p.ready = p.ready[n:]
+			return n, nil
+		}
+		if c.readErr != nil {
+			return 0, c.readErr
+		}
+		if p.passthrough() {
+			return c.Conn.Read(b)
+		}
+		// Bodies of earlier requests don't need to be copied through the parser
+		if remaining := p.bodyRemaining(); remaining > 0 {
+			if int64(len(b)) > remaining {
+				b = b[:remaining]
 			}
+			n, err := c.Conn.Read(b)
+			p.skipBody(n)
+			return n, err
+		}
 
-			// If not SSTP, ignore further bytes and passthrough
-			if !bytes.Equal(checkSlice, []byte(MethodCheckString)) {
-				c.ignoreFurther = true
-				return n, nil
+		if cap(c.buf) < len(b) {
+			c.buf = make([]byte, len(b))
+		}
+		buf := c.buf[:len(b)]
+		n, err := c.Conn.Read(buf)
+		if n > 0 {
+			c.log.Debug("Read handshake bytes", zap.Int("bytes", n), zap.Stringer("remote", c.RemoteAddr()))
+			rewritten := p.rewritten
+			p.feed(buf[:n])
+			if p.rewritten && !rewritten {
+				c.log.Debug("SSTP handshake received", zap.Stringer("remote", c.RemoteAddr()))
 			}
-			c.checkedMethod = true
 		}
-	}
-
-	log.Print("SSTP packet received!")
-
-	// TODO: fix for multiple Read() calls, if Content-Length is split across multiple
-	// Find Content-Length
-	index := bytes.Index(b, []byte(HandshakeLengthOriginal))
-	if index > -1 {
-		// replace "Content-Length: 18446744073709551615"
-		// with    "Content-Length: 9223372036854775807 " (max int64)
-		replaced := []byte(HandshakeLengthReplaced)
-		for i := 0; i < 36; i++ {
-			b[index+i] = replaced[i]
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Timeout() {
+			// The deadline can be extended, e.g. net/http aborts its background read with one,
+			// so the connection is still usable and incomplete lines stay held back
+			if len(p.ready) == 0 {
+				return 0, err
+			}
+			continue
+		}
+		if err != nil {
+			// Return the held back bytes before the error
+			p.flush()
+			c.readErr = err
 		}
-		c.ignoreFurther = true
-	} else {
-		log.Print("Content-Length not found")
 	}
-
-	return n, nil
 }
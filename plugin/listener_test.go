@@ -0,0 +1,77 @@
+package plugin_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/comp500/caddy-sstp/plugin"
+	"github.com/comp500/caddy-sstp/plugin/sstptest"
+)
+
+func TestProxyProtocolHTTP2(t *testing.T) {
+	cert, err := sstptest.NewCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	defer cancel()
+	lw := &plugin.ListenerWrapper{ProxyProtocol: &plugin.ProxyProtocolConfig{Trusted: []string{"127.0.0.1"}}}
+	if err := lw.Provision(ctx); err != nil {
+		t.Fatal(err)
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "http/1.1"}}
+	remoteAddrs := make(chan string, 1)
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddrs <- r.RemoteAddr
+	})}
+	srv.Protocols = new(http.Protocols)
+	srv.Protocols.SetHTTP1(true)
+	srv.Protocols.SetHTTP2(true)
+	go srv.Serve(lw.WrapListener(tls.NewListener(ln, tlsConfig)))
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(leaf)
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			c, err := (&net.Dialer{}).DialContext(ctx, network, addr)
+			if err != nil {
+				return nil, err
+			}
+			if _, err := c.Write([]byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 443\r\n")); err != nil {
+				c.Close()
+				return nil, err
+			}
+			return c, nil
+		},
+		TLSClientConfig:   &tls.Config{RootCAs: pool, ServerName: sstptest.ServerName},
+		ForceAttemptHTTP2: true,
+	}
+	defer transport.CloseIdleConnections()
+	resp, err := (&http.Client{Transport: transport}).Get("https://" + ln.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.ProtoMajor != 2 {
+		t.Fatalf("Response protocol = %s, want HTTP/2", resp.Proto)
+	}
+	// The admin allow list is checked against this address, so it mustn't be the load balancer's
+	if remoteAddr := <-remoteAddrs; remoteAddr != "192.0.2.1:56324" {
+		t.Errorf("RemoteAddr = %s, want the PROXY protocol address", remoteAddr)
+	}
+}
@@ -0,0 +1,28 @@
+package plugin
+
+import (
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// parseLogLevel parses the name of a log level: debug, info, warn or error
+func parseLogLevel(s string) (zapcore.Level, error) {
+	return zapcore.ParseLevel(s)
+}
+
+// withLogLevel drops the messages of l below level.
+// The level of Caddy's log still applies, so debug messages are only logged if it is at DEBUG too.
+func withLogLevel(l *zap.Logger, level string) (*zap.Logger, error) {
+	if level == "" {
+		return l, nil
+	}
+	minLevel, err := parseLogLevel(level)
+	if err != nil {
+		return nil, err
+	}
+	if !l.Core().Enabled(minLevel) {
+		// Caddy's log is already above level, and levels can only be raised
+		return l, nil
+	}
+	return l.WithOptions(zap.IncreaseLevel(minLevel)), nil
+}
@@ -0,0 +1,41 @@
+package plugin
+
+import (
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestWithLogLevel(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	caddyLog := zap.New(core)
+
+	warn, err := withLogLevel(caddyLog, "warn")
+	if err != nil {
+		t.Fatal(err)
+	}
+	warn.Info("dropped")
+	warn.Warn("logged")
+
+	// Levels below Caddy's can't be enabled, and are ignored
+	debug, err := withLogLevel(caddyLog, "debug")
+	if err != nil {
+		t.Fatal(err)
+	}
+	debug.Debug("dropped")
+	debug.Info("logged")
+
+	var messages []string
+	for _, entry := range logs.All() {
+		messages = append(messages, entry.Message)
+	}
+	if len(messages) != 2 || messages[0] != "logged" || messages[1] != "logged" {
+		t.Errorf("Logged %q, want 2 messages", messages)
+	}
+
+	if _, err := withLogLevel(caddyLog, "loud"); err == nil {
+		t.Error("withLogLevel() accepted an unknown level")
+	}
+}
@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/comp500/caddy-sstp/sstp"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// metricsCollector records the metrics of every SSTP session in the process
+type metricsCollector struct {
+	activeSessions         prometheus.Gauge
+	handshakes             *prometheus.CounterVec
+	rejectedRequests       *prometheus.CounterVec
+	controlMessagesIn      *prometheus.CounterVec
+	controlMessagesOut     *prometheus.CounterVec
+	dataBytes              *prometheus.CounterVec
+	echoRTT                prometheus.Histogram
+	pppNegotiationFailures *prometheus.CounterVec
+	pppdExits              *prometheus.CounterVec
+	proxiedSessions        *prometheus.CounterVec
+	upstreamFailures       *prometheus.CounterVec
+}
+
+func newCounterVec(name, help, label string) *prometheus.CounterVec {
+	return prometheus.NewCounterVec(prometheus.CounterOpts{Name: name, Help: help}, []string{label})
+}
+
+// metrics is shared by every Server, so counters aren't reset when Caddy reloads
+var metrics = &metricsCollector{
+	activeSessions:         prometheus.NewGauge(prometheus.GaugeOpts{Name: "sstp_sessions_active", Help: "Active SSTP sessions."}),
+	handshakes:             newCounterVec("sstp_handshakes_total", "SSTP handshakes by result, either success or the reason for failure.", "result"),
+	rejectedRequests:       newCounterVec("sstp_rejected_requests_total", "SSTP requests rejected before the handshake, by reason.", "reason"),
+	controlMessagesIn:      newCounterVec("sstp_control_messages_received_total", "SSTP control messages received by message type.", "type"),
+	controlMessagesOut:     newCounterVec("sstp_control_messages_sent_total", "SSTP control messages sent by message type.", "type"),
+	dataBytes:              newCounterVec("sstp_data_bytes_total", "Bytes of encapsulated data by direction, in from clients or out to clients.", "direction"),
+	echoRTT:                prometheus.NewHistogram(prometheus.HistogramOpts{Name: "sstp_echo_rtt_seconds", Help: "Round-trip time of SSTP Echo Requests sent by the server.", Buckets: prometheus.DefBuckets}),
+	pppNegotiationFailures: newCounterVec("sstp_ppp_negotiation_failures_total", "PPP negotiation failures by protocol.", "protocol"),
+	pppdExits:              newCounterVec("sstp_pppd_exits_total", "pppd process exits by exit code.", "code"),
+	proxiedSessions:        newCounterVec("sstp_proxy_sessions_total", "SSTP sessions forwarded to each upstream.", "upstream"),
+	upstreamFailures:       newCounterVec("sstp_proxy_upstream_failures_total", "Times each SSTP upstream was marked unhealthy.", "upstream"),
+}
+
+// register adds the metrics to Caddy's registry, which serves them with its own metrics, e.g. on the admin endpoint.
+// Each config load has a new registry, and every Server registers the same collectors, so duplicates are ignored.
+func (m *metricsCollector) register(registry prometheus.Registerer) error {
+	for _, c := range []prometheus.Collector{
+		m.activeSessions, m.handshakes, m.rejectedRequests, m.controlMessagesIn, m.controlMessagesOut, m.dataBytes,
+		m.echoRTT, m.pppNegotiationFailures, m.pppdExits, m.proxiedSessions, m.upstreamFailures,
+	} {
+		err := registry.Register(c)
+		var registered prometheus.AlreadyRegisteredError
+		if err != nil && !errors.As(err, &registered) {
+			return err
+		}
+	}
+	return nil
+}
+
+// Results of a SSTP handshake, used as the result label of sstp_handshakes_total
+const (
+	handshakeSuccess             = "success"
+	handshakeUnsupportedProtocol = "unsupported_protocol"
+	handshakeRetryCountExceeded  = "retry_count_exceeded"
+	handshakeCryptoBinding       = "crypto_binding"
+	handshakeInvalidMessage      = "invalid_message"
+	handshakeAborted             = "aborted"
+	handshakeServerFailure       = "server_failure"
+	handshakePPPFailed           = "ppp_failed"
+	handshakeTimeout             = "timeout"
+	handshakeClosed              = "closed"
+)
+
+func (m *metricsCollector) sessionStarted() {
+	m.activeSessions.Inc()
+}
+
+func (m *metricsCollector) sessionFinished() {
+	m.activeSessions.Dec()
+}
+
+func (m *metricsCollector) handshake(result string) {
+	m.handshakes.WithLabelValues(result).Inc()
+}
+
+func (m *metricsCollector) requestRejected(reason string) {
+	m.rejectedRequests.WithLabelValues(reason).Inc()
+}
+
+func (m *metricsCollector) controlMessageReceived(messageType sstp.MessageType) {
+	m.controlMessagesIn.WithLabelValues(messageType.String()).Inc()
+}
+
+func (m *metricsCollector) controlMessageSent(messageType sstp.MessageType) {
+	m.controlMessagesOut.WithLabelValues(messageType.String()).Inc()
+}
+
+func (m *metricsCollector) dataReceived(n int) {
+	m.dataBytes.WithLabelValues("in").Add(float64(n))
+}
+
+func (m *metricsCollector) dataSent(n int) {
+	m.dataBytes.WithLabelValues("out").Add(float64(n))
+}
+
+func (m *metricsCollector) echoReceived(rtt time.Duration) {
+	m.echoRTT.Observe(rtt.Seconds())
+}
+
+// NegotiationFailed implements ppp.Observer
+func (m *metricsCollector) NegotiationFailed(protocol string) {
+	m.pppNegotiationFailures.WithLabelValues(protocol).Inc()
+}
+
+// ProcessExited implements ppp.Observer
+func (m *metricsCollector) ProcessExited(exitCode int) {
+	m.pppdExits.WithLabelValues(strconv.Itoa(exitCode)).Inc()
+}
+
+func (m *metricsCollector) sessionProxied(upstream string) {
+	m.proxiedSessions.WithLabelValues(upstream).Inc()
+}
+
+func (m *metricsCollector) upstreamFailed(upstream string) {
+	m.upstreamFailures.WithLabelValues(upstream).Inc()
+}
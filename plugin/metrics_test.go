@@ -0,0 +1,38 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsRegister(t *testing.T) {
+	registry := prometheus.NewPedanticRegistry()
+	// Every Server in a config registers the same collectors
+	for i := 0; i < 2; i++ {
+		if err := metrics.register(registry); err != nil {
+			t.Fatalf("register() = %v", err)
+		}
+	}
+
+	before := testutil.ToFloat64(metrics.handshakes.WithLabelValues(handshakeSuccess))
+	metrics.handshake(handshakeSuccess)
+	if got := testutil.ToFloat64(metrics.handshakes.WithLabelValues(handshakeSuccess)); got != before+1 {
+		t.Errorf("sstp_handshakes_total{result=%q} = %g, want %g", handshakeSuccess, got, before+1)
+	}
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, family := range families {
+		if family.GetName() == "sstp_handshakes_total" {
+			found = true
+		}
+	}
+	if !found {
+		t.Error("sstp_handshakes_total not gathered from the registry")
+	}
+}
@@ -0,0 +1,584 @@
+package plugin
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"runtime/debug"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/comp500/caddy-sstp/sstp"
+	"go.uber.org/zap"
+)
+
+// ProxyConfig forwards SSTP sessions to upstream SSTP servers, instead of ending PPP locally.
+//
+// The client's Call Connected is relayed unchanged, as its Compound MAC can't be recomputed without the HLAK,
+// so upstreams must expect the hash of the certificate Caddy serves: Caddy upstreams can pin it with cert_hash,
+// and other servers must use the same certificate. An error is logged for upstreams serving another certificate.
+type ProxyConfig struct {
+	// The upstream SSTP servers, as host:port
+	Upstreams []string `json:"upstreams,omitempty"`
+	// How upstreams are chosen: round_robin (the default), random or least_conn
+	LoadBalancing string `json:"lb_policy,omitempty"`
+
+	DialTimeout    caddy.Duration `json:"dial_timeout,omitempty"`
+	HealthInterval caddy.Duration `json:"health_interval,omitempty"`
+	HealthTimeout  caddy.Duration `json:"health_timeout,omitempty"`
+
+	// The name used to verify upstream certificates, and sent as the Host header, defaults to the upstream host
+	TLSServerName string `json:"tls_server_name,omitempty"`
+	// A PEM file of CA certificates trusted for upstream certificates, instead of the system roots
+	TLSCA                 string `json:"tls_ca,omitempty"`
+	TLSInsecureSkipVerify bool   `json:"tls_insecure_skip_verify,omitempty"`
+}
+
+// Defaults for ProxyConfig
+const (
+	DefaultProxyDialTimeout    = 10 * time.Second
+	DefaultProxyHealthInterval = 30 * time.Second
+	DefaultProxyHealthTimeout  = 5 * time.Second
+)
+
+// lbPolicies are the names of the load balancing policies that can be configured
+var lbPolicies = map[string]bool{"round_robin": true, "random": true, "least_conn": true}
+
+// upstream is an upstream SSTP server
+type upstream struct {
+	addr      string
+	host      string
+	unhealthy int32 // Accessed atomically
+	sessions  int64 // Accessed atomically
+	// Set if the upstream's certificate isn't one clients are served, accessed atomically
+	certMismatch int32
+}
+
+func (u *upstream) healthy() bool {
+	return atomic.LoadInt32(&u.unhealthy) == 0
+}
+
+// setHealthy records the health of the upstream, returning true if it changed
+func (u *upstream) setHealthy(healthy bool) bool {
+	var value int32
+	if !healthy {
+		value = 1
+	}
+	return atomic.SwapInt32(&u.unhealthy, value) != value
+}
+
+// setCertMismatch records whether the upstream's certificate differs from those served, returning true if it changed
+func (u *upstream) setCertMismatch(mismatch bool) bool {
+	var value int32
+	if mismatch {
+		value = 1
+	}
+	return atomic.SwapInt32(&u.certMismatch, value) != value
+}
+
+// proxy balances sessions across upstreams, and checks their health
+type proxy struct {
+	upstreams  []*upstream
+	policy     string
+	nextIndex  uint32 // For round_robin, accessed atomically
+	serverName string
+	tlsConfig  *tls.Config
+	// The hashes clients bind to, from cert_hash, and whether cert_hash is off
+	certHashes   certHashes
+	skipCertHash bool
+
+	dialTimeout    time.Duration
+	healthInterval time.Duration
+	healthTimeout  time.Duration
+
+	log      *zap.Logger
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+func newProxy(c *ProxyConfig, log *zap.Logger) (*proxy, error) {
+	if len(c.Upstreams) == 0 {
+		return nil, errors.New("no upstreams")
+	}
+	p := &proxy{
+		policy:         c.LoadBalancing,
+		serverName:     c.TLSServerName,
+		dialTimeout:    durationOrDefault(time.Duration(c.DialTimeout), DefaultProxyDialTimeout),
+		healthInterval: durationOrDefault(time.Duration(c.HealthInterval), DefaultProxyHealthInterval),
+		healthTimeout:  durationOrDefault(time.Duration(c.HealthTimeout), DefaultProxyHealthTimeout),
+		log:            log,
+		stop:           make(chan struct{}),
+	}
+	if p.policy == "" {
+		p.policy = "round_robin"
+	}
+	if !lbPolicies[p.policy] {
+		return nil, fmt.Errorf("unknown lb_policy %q, expected round_robin, random or least_conn", p.policy)
+	}
+	for _, addr := range c.Upstreams {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream %q: %s", addr, err)
+		}
+		p.upstreams = append(p.upstreams, &upstream{addr: addr, host: host})
+	}
+
+	p.tlsConfig = &tls.Config{InsecureSkipVerify: c.TLSInsecureSkipVerify, NextProtos: []string{"http/1.1"}}
+	if c.TLSCA != "" {
+		pem, err := ioutil.ReadFile(c.TLSCA)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", c.TLSCA)
+		}
+		p.tlsConfig.RootCAs = pool
+	}
+	return p, nil
+}
+
+// start starts checking the health of the upstreams
+func (p *proxy) start() {
+	go p.checkCertificates()
+	go func() {
+		ticker := time.NewTicker(p.healthInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				p.checkHealth()
+			case <-p.stop:
+				return
+			}
+		}
+	}()
+}
+
+// close stops checking the health of the upstreams
+func (p *proxy) close() {
+	p.stopOnce.Do(func() { close(p.stop) })
+}
+
+// checkHealth checks that every upstream accepts a SSTP handshake in time
+func (p *proxy) checkHealth() {
+	var wg sync.WaitGroup
+	for _, u := range p.upstreams {
+		wg.Add(1)
+		go func(u *upstream) {
+			defer wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), p.healthTimeout)
+			defer cancel()
+			p.recordHealth(u, p.checkUpstream(ctx, u))
+		}(u)
+	}
+	wg.Wait()
+}
+
+// checkUpstream completes the HTTP handshake with an upstream, then closes the connection.
+// A TLS handshake alone would pass upstreams that don't serve SSTP, or reject every session.
+func (p *proxy) checkUpstream(ctx context.Context, u *upstream) error {
+	correlationID, err := sstp.NewCorrelationID()
+	if err != nil {
+		return err
+	}
+	conn, _, err := p.handshake(ctx, u, correlationID)
+	if err != nil {
+		return err
+	}
+	return conn.Close()
+}
+
+// checkCertificates connects to each upstream to check its certificate, without waiting for a health check.
+// Nothing is checked if the certificates clients bind to aren't known yet.
+func (p *proxy) checkCertificates() {
+	if p.expectedCertHashes() == nil {
+		return
+	}
+	for _, u := range p.upstreams {
+		go func(u *upstream) {
+			ctx, cancel := context.WithTimeout(context.Background(), p.healthTimeout)
+			defer cancel()
+			conn, err := p.dialTLS(ctx, u)
+			if err == nil {
+				conn.Close()
+			}
+		}(u)
+	}
+}
+
+// expectedCertHashes returns the hashes of the certificates clients bind to, or nil if they aren't known or checked.
+// Without cert_hash, these are the certificates Caddy has recently served for any name.
+func (p *proxy) expectedCertHashes() certHashes {
+	if p.skipCertHash {
+		return nil
+	}
+	if p.certHashes != nil {
+		return p.certHashes
+	}
+	certs := servedCertificates.certificates(time.Now())
+	if len(certs) == 0 {
+		return nil
+	}
+	hashes, err := newCertHashes(certs...)
+	if err != nil {
+		return nil
+	}
+	return hashes
+}
+
+// checkCertificate logs an error if an upstream's certificate isn't one clients bind to.
+// The client's Call Connected is relayed unchanged, so such an upstream rejects every session,
+// unless it pins the certificate Caddy serves with cert_hash, or doesn't check it.
+func (p *proxy) checkCertificate(u *upstream, state tls.ConnectionState) {
+	hashes := p.expectedCertHashes()
+	if hashes == nil || len(state.PeerCertificates) == 0 {
+		return
+	}
+	mismatch := true
+	for hp := range hashes {
+		hash, err := sstp.CertHash(hp, state.PeerCertificates[0].Raw)
+		if err == nil && hashes.check(hp, hash) == nil {
+			mismatch = false
+			break
+		}
+	}
+	if !u.setCertMismatch(mismatch) {
+		return
+	}
+	if mismatch {
+		p.log.Error("SSTP upstream certificate differs from the one clients are served, so crypto binding will fail unless the upstream sets cert_hash",
+			zap.String("upstream", u.addr), zap.String("tls_server_name", state.ServerName))
+	} else {
+		p.log.Info("SSTP upstream certificate matches the one clients are served", zap.String("upstream", u.addr))
+	}
+}
+
+// recordHealth marks an upstream healthy or unhealthy, after a health check or a dial
+func (p *proxy) recordHealth(u *upstream, err error) {
+	if !u.setHealthy(err == nil) {
+		return
+	}
+	if err != nil {
+		p.log.Warn("SSTP upstream unhealthy", zap.String("upstream", u.addr), zap.Error(err))
+		metrics.upstreamFailed(u.addr)
+	} else {
+		p.log.Info("SSTP upstream healthy", zap.String("upstream", u.addr))
+	}
+}
+
+// pick chooses a healthy upstream that hasn't been tried, or returns nil if there are none
+func (p *proxy) pick(tried map[*upstream]bool) *upstream {
+	candidates := make([]*upstream, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		if u.healthy() && !tried[u] {
+			candidates = append(candidates, u)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil
+	}
+
+	switch p.policy {
+	case "random":
+		return candidates[rand.Intn(len(candidates))]
+	case "least_conn":
+		least := candidates[0]
+		for _, u := range candidates[1:] {
+			if atomic.LoadInt64(&u.sessions) < atomic.LoadInt64(&least.sessions) {
+				least = u
+			}
+		}
+		return least
+	default:
+		return candidates[int(atomic.AddUint32(&p.nextIndex, 1)-1)%len(candidates)]
+	}
+}
+
+func (p *proxy) dialTLS(ctx context.Context, u *upstream) (*tls.Conn, error) {
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "tcp", u.addr)
+	if err != nil {
+		return nil, err
+	}
+	config := p.tlsConfig.Clone()
+	config.ServerName = p.serverName
+	if config.ServerName == "" {
+		config.ServerName = u.host
+	}
+	tlsConn := tls.Client(conn, config)
+	err = tlsConn.HandshakeContext(ctx)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	p.checkCertificate(u, tlsConn.ConnectionState())
+	return tlsConn, nil
+}
+
+// connect opens a SSTP connection to an upstream, completing the HTTP handshake with the client's correlation ID.
+// Upstreams that fail are marked unhealthy, and the next is tried.
+func (p *proxy) connect(ctx context.Context, correlationID string) (*upstream, net.Conn, *sstp.Reader, error) {
+	tried := make(map[*upstream]bool)
+	for {
+		u := p.pick(tried)
+		if u == nil {
+			return nil, nil, nil, errors.New("No healthy SSTP upstreams")
+		}
+		tried[u] = true
+
+		conn, reader, err := p.handshake(ctx, u, correlationID)
+		if err == nil {
+			return u, conn, reader, nil
+		}
+		if ctx.Err() != nil {
+			return nil, nil, nil, ctx.Err()
+		}
+		p.recordHealth(u, err)
+	}
+}
+
+func (p *proxy) handshake(ctx context.Context, u *upstream, correlationID string) (net.Conn, *sstp.Reader, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.dialTimeout)
+	defer cancel()
+	conn, err := p.dialTLS(ctx, u)
+	if err != nil {
+		return nil, nil, err
+	}
+	host := p.serverName
+	if host == "" {
+		host = u.host
+	}
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+	reader, err := sstp.ClientHandshake(conn, host, correlationID)
+	conn.SetDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, nil, err
+	}
+	return conn, reader, nil
+}
+
+// relayPacket is a packet read from one side of a proxied session
+type relayPacket struct {
+	header sstp.Header
+	packet []byte
+}
+
+// readPackets reads packets from reader until it fails, sending them to ch and the error to eCh
+func readPackets(reader *sstp.Reader, ch chan<- relayPacket, eCh chan<- error, done <-chan struct{}) {
+	for {
+		header, packet, err := reader.ReadPacket()
+		if err != nil {
+			eCh <- err
+			return
+		}
+		select {
+		case ch <- relayPacket{header, packet}:
+		case <-done:
+			return
+		}
+	}
+}
+
+// controlMessageType returns the message type of a control packet, or an error if it is invalid
+func controlMessageType(packet []byte) (sstp.MessageType, error) {
+	var controlPacket sstp.ControlPacket
+	if err := controlPacket.UnmarshalBinary(packet); err != nil {
+		return 0, err
+	}
+	return controlPacket.MessageType, nil
+}
+
+// proxyConnection relays SSTP packets between a client and an upstream, after both HTTP handshakes.
+// The Call Connected sent by the client is checked against the certificate the client was served.
+func (s *Server) proxyConnection(c net.Conn, r io.Reader, u *upstream, upstreamConn net.Conn, upstreamReader *sstp.Reader, hashes certHashes, correlationID string) {
+	defer c.Close()
+	defer upstreamConn.Close()
+	defer func() {
+		if err := recover(); err != nil {
+			s.log.Error("SSTP session failed", zap.Stringer("remote", c.RemoteAddr()), zap.String("correlation_id", correlationID), zap.Any("error", err), zap.ByteString("stack", debug.Stack()))
+		}
+	}()
+
+	sess := &session{
+		conn:          c,
+		correlationID: correlationID,
+		upstream:      u.addr,
+		certHashes:    hashes,
+		abortTimeout:  durationOrDefault(time.Duration(s.AbortTimeout), DefaultAbortTimeout),
+	}
+	if !s.sessions.add(sess) {
+		s.log.Info("Server is shutting down, closing new connection", zap.Stringer("remote", c.RemoteAddr()), zap.String("correlation_id", correlationID))
+		return
+	}
+	sess.log = s.log.With(zap.String("session", sess.id), zap.Stringer("remote", c.RemoteAddr()), zap.String("correlation_id", correlationID), zap.String("upstream", u.addr))
+	sess.log.Info("Proxied session started")
+	defer s.sessions.remove(sess)
+	atomic.AddInt64(&u.sessions, 1)
+	defer atomic.AddInt64(&u.sessions, -1)
+	metrics.sessionStarted()
+	defer metrics.sessionFinished()
+	metrics.sessionProxied(u.addr)
+
+	done := make(chan struct{})
+	defer close(done)
+	clientCh, upstreamCh := make(chan relayPacket), make(chan relayPacket)
+	clientErr, upstreamErr := make(chan error, 1), make(chan error, 1)
+	clientReader := sstp.NewReader(r)
+	go readPackets(clientReader, clientCh, clientErr, done)
+	go readPackets(upstreamReader, upstreamCh, upstreamErr, done)
+
+	// Set when the proxy is tearing the session down itself, and waits for both sides to reply
+	var teardownTimer <-chan time.Time
+	var clientDone, upstreamDone bool
+	sendBoth := func(message sstp.Message) {
+		packet, err := message.MarshalBinary()
+		if err != nil {
+			sess.log.Error("Failed to encode control message", zap.Stringer("type", message.MessageType()), zap.Error(err))
+			return
+		}
+		c.Write(packet)
+		upstreamConn.Write(packet)
+		teardownTimer = time.After(sess.abortTimeout)
+	}
+	invalidFrame := &sstp.CallAbort{StatusInfos: []sstp.StatusInfo{{Status: sstp.AttributeStatusInvalidFrameReceived}}}
+
+	for {
+		select {
+		case p := <-clientCh:
+			connected := false // Set for the first Call Connected, once its certificate hash is checked
+			if teardownTimer != nil {
+				if messageType, err := controlMessageType(p.packet); err == nil && p.header.C && endsTeardown(messageType) {
+					clientDone = true
+				}
+				clientReader.Release(p.packet)
+				if clientDone && upstreamDone {
+					return
+				}
+				continue
+			}
+			if p.header.C {
+				messageType, err := controlMessageType(p.packet)
+				if err != nil {
+					sess.log.Warn("Invalid control packet from client, aborting connection", zap.Error(err))
+					clientReader.Release(p.packet)
+					sendBoth(invalidFrame)
+					continue
+				}
+				metrics.controlMessageReceived(messageType)
+				if messageType == sstp.MessageTypeCallConnected {
+					if err := sess.checkCertHash(p.packet); err != nil {
+						sess.log.Warn("Crypto binding failed, aborting connection", zap.Error(err))
+						metrics.handshake(handshakeCryptoBinding)
+						clientReader.Release(p.packet)
+						sendBoth(&sstp.CallAbort{StatusInfos: []sstp.StatusInfo{{AttribID: sstp.AttributeIDCryptoBinding, Status: sstp.AttributeStatusInvalidFrameReceived}}})
+						continue
+					}
+					connected = !sess.handshakeDone
+				}
+			} else {
+				atomic.AddUint64(&sess.bytesIn, uint64(len(p.packet)-sstp.HeaderLength))
+				metrics.dataReceived(len(p.packet) - sstp.HeaderLength)
+			}
+			_, err := upstreamConn.Write(p.packet)
+			clientReader.Release(p.packet)
+			if err != nil {
+				sess.log.Warn("Failed to write to upstream", zap.Error(err))
+				return
+			}
+			if connected {
+				// The upstream checks the Compound MAC, and aborts if it is wrong
+				sess.handshakeDone = true
+				metrics.handshake(handshakeSuccess)
+			}
+		case p := <-upstreamCh:
+			if teardownTimer != nil {
+				if messageType, err := controlMessageType(p.packet); err == nil && p.header.C && endsTeardown(messageType) {
+					upstreamDone = true
+				}
+				upstreamReader.Release(p.packet)
+				if clientDone && upstreamDone {
+					return
+				}
+				continue
+			}
+			if p.header.C {
+				messageType, err := controlMessageType(p.packet)
+				if err != nil {
+					sess.log.Warn("Invalid control packet from upstream, aborting connection", zap.Error(err))
+					upstreamReader.Release(p.packet)
+					sendBoth(invalidFrame)
+					continue
+				}
+				metrics.controlMessageSent(messageType)
+			} else {
+				atomic.AddUint64(&sess.bytesOut, uint64(len(p.packet)-sstp.HeaderLength))
+				metrics.dataSent(len(p.packet) - sstp.HeaderLength)
+			}
+			_, err := c.Write(p.packet)
+			upstreamReader.Release(p.packet)
+			if err != nil {
+				sess.log.Warn("Failed to write to client", zap.Error(err))
+				return
+			}
+		case err := <-clientErr:
+			if err == io.EOF {
+				sess.log.Info("Client closed connection")
+			} else {
+				sess.log.Warn("Failed to read from client", zap.Error(err))
+				if isFramingError(err) {
+					if packet, err := invalidFrame.MarshalBinary(); err == nil {
+						c.Write(packet)
+						upstreamConn.Write(packet)
+					}
+				}
+			}
+			return
+		case err := <-upstreamErr:
+			if err == io.EOF {
+				sess.log.Info("Upstream closed connection")
+			} else {
+				sess.log.Warn("Failed to read from upstream", zap.Error(err))
+			}
+			return
+		case <-sess.shutdown: // This case means the server is shutting down, or the session was disconnected by an admin
+			sess.shutdown = nil
+			if teardownTimer == nil {
+				sess.log.Info("Disconnecting proxied session")
+				sendBoth(&sstp.CallDisconnect{})
+			}
+		case <-teardownTimer: // This case means a side didn't respond to Call Abort or Call Disconnect in time
+			return
+		}
+	}
+}
+
+// endsTeardown returns true if a message finishes a Call Disconnect or Call Abort sent by the proxy
+func endsTeardown(messageType sstp.MessageType) bool {
+	switch messageType {
+	case sstp.MessageTypeCallDisconnectAck, sstp.MessageTypeCallAbort, sstp.MessageTypeCallDisconnect:
+		return true
+	}
+	return false
+}
+
+// checkCertHash checks the certificate hash of the client's Call Connected.
+// The Compound MAC is left to the upstream, which has the HLAK.
+func (s *session) checkCertHash(packet []byte) error {
+	var message sstp.CallConnected
+	err := message.UnmarshalBinary(packet)
+	if err != nil {
+		return err
+	}
+	return s.certHashes.check(message.CryptoBinding.HashProtocol, message.CryptoBinding.CertHash)
+}
@@ -0,0 +1,204 @@
+package plugin_test
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/comp500/caddy-sstp/plugin"
+	"github.com/comp500/caddy-sstp/plugin/sstptest"
+	"github.com/comp500/caddy-sstp/sstp"
+)
+
+// newUpstream starts a SSTP server for a proxy to forward sessions to.
+// Clients bind to the proxy's certificate, so the upstream doesn't check the certificate hash.
+func newUpstream(t *testing.T) *sstptest.Harness {
+	return sstptest.New(t, &plugin.Server{CertHash: &plugin.CertHashConfig{Off: true}})
+}
+
+// newProxy starts a SSTP server that forwards sessions to upstreams
+func newProxy(t *testing.T, upstreams ...string) *sstptest.Harness {
+	return sstptest.New(t, &plugin.Server{Proxy: &plugin.ProxyConfig{Upstreams: upstreams, TLSInsecureSkipVerify: true}})
+}
+
+// deadAddr returns an address nothing is listening on
+func deadAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	return addr
+}
+
+// dialProxy connects a Client to a proxy, using the HLAK of the upstream that ends PPP
+func dialProxy(p, upstream *sstptest.Harness) *sstptest.Client {
+	c := p.DialClient()
+	c.HLAK = upstream.HLAK
+	return c
+}
+
+func TestProxySession(t *testing.T) {
+	upstream := newUpstream(t)
+	p := newProxy(t, upstream.Addr())
+	c := dialProxy(p, upstream)
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := upstream.NextPPP()
+
+	sent := []byte{0xff, 0x03, 0x00, 0x21, 0x45}
+	err = c.WriteData(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := f.Receive(sstptest.DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, sent) {
+		t.Errorf("Upstream received %x, want %x", received, sent)
+	}
+	err = f.Send(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err = c.ReadData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, sent) {
+		t.Errorf("Client received %x, want %x", received, sent)
+	}
+}
+
+func TestProxyFailover(t *testing.T) {
+	upstream := newUpstream(t)
+	dead := deadAddr(t)
+	// Round robin tries the dead upstream first
+	p := newProxy(t, dead, upstream.Addr())
+	c := dialProxy(p, upstream)
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.NextPPP()
+	err = c.WriteMessage(&sstp.EchoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ExpectMessage(sstp.MessageTypeEchoResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The dead upstream was marked unhealthy, so the next session goes straight to the healthy one
+	c = dialProxy(p, upstream)
+	err = c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	upstream.NextPPP()
+}
+
+func TestProxyNoUpstreams(t *testing.T) {
+	p := newProxy(t, deadAddr(t), deadAddr(t))
+	c := p.DialClient()
+	err := c.WriteRaw([]byte(sstptest.HandshakeRequest()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.ReadResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Handshake status = %d, want %d", resp.StatusCode, http.StatusBadGateway)
+	}
+}
+
+func TestProxyHealthCheck(t *testing.T) {
+	upstream := newUpstream(t)
+	// Completes a TLS handshake, but doesn't serve SSTP
+	website := httptest.NewTLSServer(http.NotFoundHandler())
+	t.Cleanup(website.Close)
+	dead := deadAddr(t)
+
+	p := newProxy(t, upstream.Addr(), website.Listener.Addr().String(), dead)
+	healthy := plugin.CheckUpstreams(p.Server)
+	if want := []string{upstream.Addr()}; !reflect.DeepEqual(healthy, want) {
+		t.Errorf("Healthy upstreams = %v, want %v", healthy, want)
+	}
+}
+
+func TestProxyInvalidControlPacket(t *testing.T) {
+	upstream := newUpstream(t)
+	p := newProxy(t, upstream.Addr())
+	c := dialProxy(p, upstream)
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := upstream.NextPPP()
+	// Invalid packets have no message type, so they aren't counted
+	before := plugin.ControlMessagesReceived(0)
+
+	// An Echo Request claiming an attribute it doesn't have
+	err = c.WriteRaw([]byte{0x10, 0x01, 0x00, 0x08, 0x00, 0x08, 0x00, 0x01})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectAbort(t, c, sstp.AttributeStatusInvalidFrameReceived)
+	if got := plugin.ControlMessagesReceived(0); got != before {
+		t.Errorf("Invalid packet counted as %s", sstp.MessageType(0))
+	}
+	// The upstream is aborted too
+	if !f.WaitClosed(sstptest.DefaultTimeout) {
+		t.Error("Upstream PPP connection not closed")
+	}
+}
+
+func TestProxyHandshakeCounted(t *testing.T) {
+	upstream := newUpstream(t)
+	p := newProxy(t, upstream.Addr())
+	before := plugin.HandshakesTotal("success")
+	c := dialProxy(p, upstream)
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := upstream.NextPPP()
+	// Both have handled Call Connected once the upstream receives data sent after it
+	err = c.WriteData([]byte{0xff, 0x03, 0x00, 0x21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Receive(sstptest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	// The upstream runs in this process, so it counts the session too
+	if got := plugin.HandshakesTotal("success") - before; got != 2 {
+		t.Errorf("Successful handshakes counted = %v, want 2", got)
+	}
+}
+
+func TestProxyUpstreamCertificateMismatch(t *testing.T) {
+	pinned, mismatched := newUpstream(t), newUpstream(t)
+	hash := sha256.Sum256(pinned.Certificate.Raw)
+	p := sstptest.New(t, &plugin.Server{
+		CertHash: &plugin.CertHashConfig{SHA256: hex.EncodeToString(hash[:])},
+		Proxy:    &plugin.ProxyConfig{Upstreams: []string{pinned.Addr(), mismatched.Addr()}, TLSInsecureSkipVerify: true},
+	})
+
+	plugin.CheckUpstreams(p.Server)
+	if got, want := plugin.UpstreamCertificateMismatches(p.Server), []string{mismatched.Addr()}; !reflect.DeepEqual(got, want) {
+		t.Errorf("Upstreams with another certificate = %v, want %v", got, want)
+	}
+}
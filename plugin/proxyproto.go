@@ -0,0 +1,128 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// ProxyProtocolConfig enables the PROXY protocol on connections from trusted load balancers
+type ProxyProtocolConfig struct {
+	// The networks that are trusted to send a PROXY protocol header.
+	// Connections from them must start with a header; other connections are never parsed.
+	Trusted []string `json:"trusted,omitempty"`
+}
+
+// proxyV2Signature starts every PROXY protocol v2 header
+var proxyV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// The longest PROXY protocol v1 header, including the line ending
+const proxyV1MaxLength = 107
+
+// Errors returned when reading PROXY protocol headers
+var (
+	ErrProxyHeader        = errors.New("Invalid PROXY protocol header")
+	ErrProxyHeaderMissing = errors.New("PROXY protocol header missing")
+)
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header, without reading any bytes after it.
+// It returns the client address, or nil if the header doesn't give one, e.g. for health checks.
+func readProxyHeader(r io.Reader) (net.Addr, error) {
+	// Both versions are at least this long, so this never reads past the header
+	start := make([]byte, len(proxyV2Signature))
+	if _, err := io.ReadFull(r, start); err != nil {
+		return nil, err
+	}
+	switch {
+	case bytes.Equal(start, proxyV2Signature):
+		return readProxyV2(r)
+	case bytes.HasPrefix(start, []byte("PROXY ")):
+		return readProxyV1(r, start)
+	default:
+		return nil, ErrProxyHeaderMissing
+	}
+}
+
+// readProxyV1 reads the rest of a PROXY protocol v1 header, e.g. "PROXY TCP4 <src> <dst> <sport> <dport>\r\n"
+func readProxyV1(r io.Reader, start []byte) (net.Addr, error) {
+	line := append([]byte(nil), start...)
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= proxyV1MaxLength {
+			return nil, ErrProxyHeader
+		}
+		if _, err := io.ReadFull(r, b); err != nil {
+			if err == io.EOF {
+				// The header has started, so it was cut short
+				err = io.ErrUnexpectedEOF
+			}
+			return nil, err
+		}
+		line = append(line, b[0])
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, ErrProxyHeader
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil {
+		return nil, ErrProxyHeader
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// readProxyV2 reads the rest of a PROXY protocol v2 header, after the signature
+func readProxyV2(r io.Reader) (net.Addr, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return nil, err
+	}
+	if header[0]>>4 != 2 {
+		return nil, fmt.Errorf("Unsupported PROXY protocol version %d", header[0]>>4)
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(header[2:]))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		return nil, err
+	}
+
+	const (
+		commandLocal = 0x0
+		commandProxy = 0x1
+	)
+	switch header[0] & 0xf {
+	case commandLocal:
+		// Sent by the load balancer itself, e.g. for health checks
+		return nil, nil
+	case commandProxy:
+	default:
+		return nil, ErrProxyHeader
+	}
+
+	// The address family is the high nibble, and the transport the low nibble
+	var ipLen int
+	switch header[1] >> 4 {
+	case 0x1: // AF_INET
+		ipLen = net.IPv4len
+	case 0x2: // AF_INET6
+		ipLen = net.IPv6len
+	default:
+		// AF_UNSPEC and AF_UNIX don't have an IP address
+		return nil, nil
+	}
+	if len(payload) < 2*ipLen+4 {
+		return nil, ErrProxyHeader
+	}
+	ip := net.IP(append([]byte(nil), payload[:ipLen]...))
+	port := binary.BigEndian.Uint16(payload[2*ipLen:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
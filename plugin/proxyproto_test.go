@@ -0,0 +1,112 @@
+package plugin
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+)
+
+// proxyV2Header builds a PROXY protocol v2 header, with the source address and port first in the payload
+func proxyV2Header(command, family byte, src net.IP, srcPort uint16, extra int) []byte {
+	var payload []byte
+	switch family {
+	case 0x1:
+		payload = append(payload, src.To4()...)
+		payload = append(payload, net.IPv4(127, 0, 0, 1).To4()...)
+	case 0x2:
+		payload = append(payload, src.To16()...)
+		payload = append(payload, net.IPv6loopback...)
+	}
+	if payload != nil {
+		payload = binary.BigEndian.AppendUint16(payload, srcPort)
+		payload = binary.BigEndian.AppendUint16(payload, 443)
+	}
+	// TLVs after the addresses are skipped
+	payload = append(payload, make([]byte, extra)...)
+
+	header := append([]byte(nil), proxyV2Signature...)
+	header = append(header, 0x20|command, family<<4|0x1)
+	header = binary.BigEndian.AppendUint16(header, uint16(len(payload)))
+	return append(header, payload...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header []byte
+		want   string // The client address, or empty if there is none
+	}{
+		{"v1 TCP4", []byte("PROXY TCP4 192.0.2.1 127.0.0.1 56324 443\r\n"), "192.0.2.1:56324"},
+		{"v1 TCP6", []byte("PROXY TCP6 2001:db8::1 ::1 56324 443\r\n"), "[2001:db8::1]:56324"},
+		{"v1 UNKNOWN", []byte("PROXY UNKNOWN\r\n"), ""},
+		{"v1 UNKNOWN with addresses", []byte("PROXY UNKNOWN 192.0.2.1 127.0.0.1 56324 443\r\n"), ""},
+		{"v2 IPv4", proxyV2Header(0x1, 0x1, net.IPv4(192, 0, 2, 1), 56324, 0), "192.0.2.1:56324"},
+		{"v2 IPv6", proxyV2Header(0x1, 0x2, net.ParseIP("2001:db8::1"), 56324, 0), "[2001:db8::1]:56324"},
+		{"v2 with TLVs", proxyV2Header(0x1, 0x1, net.IPv4(192, 0, 2, 1), 56324, 16), "192.0.2.1:56324"},
+		{"v2 LOCAL", proxyV2Header(0x0, 0x1, net.IPv4(192, 0, 2, 1), 56324, 0), ""},
+		{"v2 UNSPEC", proxyV2Header(0x1, 0x0, nil, 0, 0), ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The bytes after the header must be left unread, for the TLS handshake
+			after := []byte("\x16\x03\x01")
+			r := bytes.NewReader(append(append([]byte(nil), tt.header...), after...))
+			addr, err := readProxyHeader(r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := ""
+			if addr != nil {
+				got = addr.String()
+			}
+			if got != tt.want {
+				t.Errorf("readProxyHeader() = %q, want %q", got, tt.want)
+			}
+			if rest, _ := io.ReadAll(r); !bytes.Equal(rest, after) {
+				t.Errorf("Left %q unread, want %q", rest, after)
+			}
+		})
+	}
+}
+
+func TestReadProxyHeaderInvalid(t *testing.T) {
+	unsupported := proxyV2Header(0x1, 0x1, net.IPv4(192, 0, 2, 1), 56324, 0)
+	unsupported[len(proxyV2Signature)] = 0x31
+	badCommand := proxyV2Header(0x1, 0x1, net.IPv4(192, 0, 2, 1), 56324, 0)
+	badCommand[len(proxyV2Signature)] = 0x2f
+	short := proxyV2Header(0x1, 0x1, net.IPv4(192, 0, 2, 1), 56324, 0)
+	short = append(short[:len(proxyV2Signature)+2], 0, 4, 192, 0, 2, 1)
+
+	tests := []struct {
+		name   string
+		header []byte
+		want   error // If nil, any error is accepted
+	}{
+		{"missing", []byte("GET / HTTP/1.1\r\nHost: sstp.test\r\n\r\n"), ErrProxyHeaderMissing},
+		{"TLS client hello", append([]byte{0x16, 0x03, 0x01, 0x02, 0x00}, make([]byte, 16)...), ErrProxyHeaderMissing},
+		{"v1 bad protocol", []byte("PROXY UDP4 192.0.2.1 127.0.0.1 56324 443\r\n"), ErrProxyHeader},
+		{"v1 bad address", []byte("PROXY TCP4 192.0.2 127.0.0.1 56324 443\r\n"), ErrProxyHeader},
+		{"v1 bad port", []byte("PROXY TCP4 192.0.2.1 127.0.0.1 65536 443\r\n"), ErrProxyHeader},
+		{"v1 missing fields", []byte("PROXY TCP4 192.0.2.1 127.0.0.1\r\n"), ErrProxyHeader},
+		{"v1 too long", append([]byte("PROXY TCP4 "), bytes.Repeat([]byte("1"), 200)...), ErrProxyHeader},
+		{"v1 truncated", []byte("PROXY TCP4 192.0.2.1"), io.ErrUnexpectedEOF},
+		{"v2 unsupported version", unsupported, nil},
+		{"v2 bad command", badCommand, ErrProxyHeader},
+		{"v2 addresses too short", short, ErrProxyHeader},
+		{"v2 truncated", proxyV2Header(0x1, 0x1, net.IPv4(192, 0, 2, 1), 56324, 0)[:20], io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := readProxyHeader(bytes.NewReader(tt.header))
+			if err == nil {
+				t.Fatal("readProxyHeader() accepted an invalid header")
+			}
+			if tt.want != nil && !errors.Is(err, tt.want) {
+				t.Errorf("readProxyHeader() error = %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
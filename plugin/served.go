@@ -0,0 +1,107 @@
+package plugin
+
+import (
+	"bytes"
+	"crypto/tls"
+	"sync"
+	"time"
+)
+
+// servedCertificates remembers the leaf certificates sent in full TLS handshakes, by server name,
+// so the certificate of a resumed handshake can be found. It is shared by every Listener,
+// as a session may be resumed on another listener, e.g. after the config is reloaded.
+var servedCertificates = &servedCertificateCache{byName: make(map[string][]servedCertificate)}
+
+// Limits of servedCertificates
+const (
+	maxServedNames        = 1024               // Server names remembered
+	maxServedCertificates = 4                  // Certificates remembered per server name, e.g. across renewals
+	servedCertificateTTL  = 7 * 24 * time.Hour // The longest a TLS session can be resumed for
+)
+
+// servedCertificate is a leaf certificate, and when it was last sent in a full handshake
+type servedCertificate struct {
+	der  []byte
+	sent time.Time
+}
+
+// servedCertificateCache is the type of servedCertificates
+type servedCertificateCache struct {
+	lock   sync.Mutex
+	byName map[string][]servedCertificate
+}
+
+// handshake returns the leaf certificates the client may have been sent in a TLS handshake, for crypto binding.
+// A full handshake sends one, which is remembered. Resumed handshakes don't send a certificate,
+// so any sent for the same server name while the session could have been created may be the one the client saw.
+func (c *servedCertificateCache) handshake(state tls.ConnectionState, now time.Time) [][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	certs := c.byName[state.ServerName]
+	// Forget certificates that no resumable session could have been sent
+	live := certs[:0]
+	for _, cert := range certs {
+		if now.Sub(cert.sent) < servedCertificateTTL {
+			live = append(live, cert)
+		}
+	}
+	certs = live
+
+	if state.DidResume || len(state.LocalCertificate) == 0 {
+		c.byName[state.ServerName] = certs
+		if len(certs) == 0 {
+			delete(c.byName, state.ServerName)
+			return nil
+		}
+		ders := make([][]byte, len(certs))
+		for i, cert := range certs {
+			ders[i] = cert.der
+		}
+		return ders
+	}
+
+	leaf := state.LocalCertificate[0]
+	for i, cert := range certs {
+		if bytes.Equal(cert.der, leaf) {
+			certs = append(certs[:i], certs[i+1:]...)
+			break
+		}
+	}
+	if len(certs) >= maxServedCertificates {
+		// The certificates are in the order they were last sent, so forget the oldest
+		certs = certs[1:]
+	}
+	if _, ok := c.byName[state.ServerName]; !ok && len(c.byName) >= maxServedNames {
+		// Clients choose the server names, so forget an arbitrary one rather than growing without bound
+		for name := range c.byName {
+			delete(c.byName, name)
+			break
+		}
+	}
+	c.byName[state.ServerName] = append(certs, servedCertificate{der: leaf, sent: now})
+	return [][]byte{leaf}
+}
+
+// certificates returns every leaf certificate sent in a full handshake that a session could still be resumed with
+func (c *servedCertificateCache) certificates(now time.Time) [][]byte {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	var ders [][]byte
+	for _, certs := range c.byName {
+	next:
+		for _, cert := range certs {
+			if now.Sub(cert.sent) >= servedCertificateTTL {
+				continue
+			}
+			for _, der := range ders {
+				if bytes.Equal(der, cert.der) {
+					continue next
+				}
+			}
+			ders = append(ders, cert.der)
+		}
+	}
+	return ders
+}
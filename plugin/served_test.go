@@ -0,0 +1,53 @@
+package plugin
+
+import (
+	"crypto/tls"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestServedCertificates(t *testing.T) {
+	c := &servedCertificateCache{byName: make(map[string][]servedCertificate)}
+	now := time.Now()
+	full := func(name, cert string) tls.ConnectionState {
+		return tls.ConnectionState{ServerName: name, LocalCertificate: [][]byte{[]byte(cert)}}
+	}
+	resumed := func(name string) tls.ConnectionState {
+		return tls.ConnectionState{ServerName: name, DidResume: true}
+	}
+	certs := func(names ...string) [][]byte {
+		var ders [][]byte
+		for _, name := range names {
+			ders = append(ders, []byte(name))
+		}
+		return ders
+	}
+
+	if got := c.handshake(resumed("a.test"), now); got != nil {
+		t.Errorf("Resumed before any full handshake = %q, want none", got)
+	}
+	if got := c.handshake(full("a.test", "old"), now); !reflect.DeepEqual(got, certs("old")) {
+		t.Errorf("Full handshake = %q, want the certificate sent", got)
+	}
+	// Renewed, so sessions from either certificate may be resumed
+	c.handshake(full("a.test", "new"), now.Add(time.Hour))
+	if got := c.handshake(resumed("a.test"), now.Add(time.Hour)); !reflect.DeepEqual(got, certs("old", "new")) {
+		t.Errorf("Resumed after renewal = %q, want both certificates", got)
+	}
+	if got := c.handshake(resumed("b.test"), now); got != nil {
+		t.Errorf("Resumed for another name = %q, want none", got)
+	}
+	// Sessions created with the old certificate have expired
+	later := now.Add(servedCertificateTTL + time.Minute)
+	if got := c.handshake(resumed("a.test"), later); !reflect.DeepEqual(got, certs("new")) {
+		t.Errorf("Resumed after expiry = %q, want the new certificate", got)
+	}
+
+	for i := 0; i < maxServedCertificates+1; i++ {
+		c.handshake(full("c.test", string(rune('0'+i))), now)
+	}
+	if got := c.handshake(resumed("c.test"), now); len(got) != maxServedCertificates || string(got[0]) != "1" {
+		t.Errorf("Resumed = %q, want the last %d certificates", got, maxServedCertificates)
+	}
+}
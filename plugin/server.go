@@ -2,79 +2,303 @@ package plugin
 
 import (
 	"errors"
-	"fmt"
 	"io"
-	"log"
+	"math"
 	"net"
 	"net/http"
+	"regexp"
+	"runtime/debug"
 	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
 
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
 	"github.com/comp500/caddy-sstp/ppp"
-	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/comp500/caddy-sstp/sstp"
+	"go.uber.org/zap"
 )
 
-// Server is a httpserver.Handler that handles SSTP requests.
+// Server is a Caddy HTTP handler (http.handlers.sstp) that handles SSTP requests.
+// It must be used together with ListenerWrapper, which makes SSTP handshakes readable by net/http.
 type Server struct {
-	NextHandler httpserver.Handler
-	destIP      net.IP
-	srcIP       net.IP
-	extraArgs   []string
+	// The IP addresses of the server and client ends of the PPP link
+	SrcIP  string `json:"src_ip,omitempty"`
+	DestIP string `json:"dest_ip,omitempty"`
+	// Extra arguments passed to pppd
+	Args []string `json:"args,omitempty"`
+	// The PPP backend: pppd, tuntap or vnat
+	Backend     string `json:"backend,omitempty"`
+	PppdPath    string `json:"pppd_path,omitempty"`
+	PppdOptions string `json:"pppd_options,omitempty"`
+
+	HelloInterval      caddy.Duration `json:"hello_interval,omitempty"`
+	NegotiationTimeout caddy.Duration `json:"negotiation_timeout,omitempty"`
+	AbortTimeout       caddy.Duration `json:"abort_timeout,omitempty"`
+	// The path SSTP handshakes are accepted on, defaults to RequestPath
+	Path string `json:"path,omitempty"`
+
+	Admin *AdminConfig `json:"admin,omitempty"`
+	// The minimum level of messages logged, in addition to the level of Caddy's log
+	LogLevel string `json:"log_level,omitempty"`
+	// The Server header of the handshake response, defaults to DefaultServerHeader; "off" omits it
+	ServerHeader string          `json:"server_header,omitempty"`
+	CertHash     *CertHashConfig `json:"cert_hash,omitempty"`
+	// Accepts sessions without checking the crypto binding Compound MAC, which the pppd backend needs,
+	// as it can't export the HLAK. This leaves sessions open to man-in-the-middle attacks.
+	SkipCompoundMAC bool          `json:"skip_compound_mac,omitempty"`
+	Limits          *LimitsConfig `json:"limits,omitempty"`
+	Access          *AccessConfig `json:"access,omitempty"`
+	// Forwards sessions to upstream SSTP servers, instead of using the PPP backend
+	Proxy *ProxyConfig `json:"proxy,omitempty"`
+
+	// Starts the PPP connection of each session instead of the backend, e.g. with a fake in tests
+	PPPBackend func(ppp.Config) (ppp.Connection, error) `json:"-"`
+
+	destIP         net.IP
+	srcIP          net.IP
+	connectionType ppp.ConnectionType
+	sessions       *sessionTracker
+	limiter        *sessionLimiter
+	access         accessRules
+	proxy          *proxy
+
+	admin        adminConfig
+	log          *zap.Logger
+	certHashes   certHashes // Pinned certificate hashes, used instead of the TLS connection's certificate
+	skipCertHash bool       // Set by cert_hash off
 }
 
 // MethodSstp is the SSTP handshake's HTTP method.
-const MethodSstp = "SSTP_DUPLEX_POST"
+const MethodSstp = sstp.Method
 
 // RequestPath is the path that the SSTP handshake uses.
-const RequestPath = "/sra_{BA195980-CD49-458b-9E23-C84EE0ADCD75}/"
+const RequestPath = sstp.RequestPath
 
-// TODO: don't use this horrible function
-func handleErr(err error) {
-	if err != nil {
-		log.Fatalf("%s\n", err)
+// DefaultServerHeader is the Server header sent in the handshake response, the same as Windows servers send.
+const DefaultServerHeader = "Microsoft-HTTPAPI/2.0"
+
+// DefaultHelloInterval is the time without receiving any packets after which an Echo Request is sent.
+// If no response is received within another interval, the connection is aborted.
+const DefaultHelloInterval = 60 * time.Second
+
+// DefaultNegotiationTimeout is how long the client has to complete the SSTP handshake after the HTTP handshake.
+const DefaultNegotiationTimeout = 60 * time.Second
+
+// DefaultAbortTimeout is how long to wait for the client to acknowledge Call Abort or Call Disconnect.
+const DefaultAbortTimeout = 1 * time.Second
+
+// durationOrDefault returns d, or def if d is unset
+func durationOrDefault(d, def time.Duration) time.Duration {
+	if d == 0 {
+		return def
 	}
+	return d
 }
 
-// Serves SSTP requests. See httpserver.Handler.
-func (s Server) ServeHTTP(w http.ResponseWriter, r *http.Request) (int, error) {
-	if r.Method == MethodSstp {
-		if httpserver.Path(r.URL.Path).Matches(RequestPath) {
-			if r.ProtoMajor != 1 { // We don't support HTTP2
-				return http.StatusHTTPVersionNotSupported, errors.New("Unsupported HTTP major version: " + strconv.Itoa(r.ProtoMajor))
-			}
+// sstpRequestPath returns the path that SSTP handshakes are accepted on
+func (s *Server) sstpRequestPath() string {
+	if s.Path == "" {
+		return RequestPath
+	}
+	return s.Path
+}
 
-			log.Print("Got a sstp request")
+// ServeHTTP serves SSTP requests. See caddyhttp.MiddlewareHandler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request, next caddyhttp.Handler) error {
+	if s.admin.matches(r) {
+		return s.serveAdmin(w, r)
+	}
+	if r.Method != MethodSstp || !strings.HasPrefix(r.URL.Path, s.sstpRequestPath()) {
+		return next.ServeHTTP(w, r)
+	}
+	if r.ProtoMajor != 1 { // We don't support HTTP2
+		return caddyhttp.Error(http.StatusHTTPVersionNotSupported, errors.New("Unsupported HTTP major version: "+strconv.Itoa(r.ProtoMajor)))
+	}
 
-			hijacker, ok := w.(http.Hijacker)
-			if !ok {
-				return http.StatusInternalServerError, errors.New("ResponseWriter does not implement Hijacker")
-			}
-			// Hijack connection
-			// Ignore returned bufio.Reader, as client will only give more data after first response
-			clientConn, _, err := hijacker.Hijack()
-			if err != nil {
-				return http.StatusInternalServerError, errors.New("failed to hijack: " + err.Error())
-			}
+	correlationID := r.Header.Get("SSTPCORRELATIONID")
+	s.log.Debug("SSTP request received", zap.String("remote", r.RemoteAddr), zap.String("correlation_id", correlationID))
+	ip := remoteIP(r)
+	if !s.access.allowed(net.ParseIP(ip)) {
+		s.log.Info("SSTP request denied", zap.String("remote", r.RemoteAddr), zap.String("correlation_id", correlationID))
+		metrics.requestRejected(rejectAccessDenied)
+		if s.access.forbid {
+			return caddyhttp.Error(http.StatusForbidden, errors.New("SSTP not allowed from "+ip))
+		}
+		// Look like any other site to denied clients
+		return next.ServeHTTP(w, r)
+	}
+	if err := validateHandshake(r, correlationID); err != nil {
+		s.log.Warn("Invalid SSTP request", zap.String("remote", r.RemoteAddr), zap.String("correlation_id", correlationID), zap.Error(err))
+		metrics.requestRejected(rejectInvalidRequest)
+		return caddyhttp.Error(http.StatusBadRequest, err)
+	}
+	if s.sessions.isClosing() {
+		return caddyhttp.Error(http.StatusServiceUnavailable, errors.New("Server is shutting down"))
+	}
 
-			n, err := fmt.Fprintf(clientConn, "%s\r\n%s\r\n%s\r\n%s\r\n\r\n",
-				"HTTP/1.1 200 OK",
-				"Date: Thu, 09 Nov 2006 00:51:09 GMT",
-				"Server: Microsoft-HTTPAPI/2.0",
-				"Content-Length: 18446744073709551615")
-			if err != nil {
-				clientConn.Close()
-				return http.StatusInternalServerError, errors.New("Failed to send response")
-			}
+	// Limits are checked before hijacking, so the client gets a proper HTTP response
+	if reason, retryAfter := s.limiter.acquire(ip, time.Now()); reason != "" {
+		s.log.Warn("SSTP request rejected", zap.String("remote", r.RemoteAddr), zap.String("correlation_id", correlationID), zap.String("reason", reason))
+		metrics.requestRejected(reason)
+		if retryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retryAfter.Seconds()))))
+		}
+		return caddyhttp.Error(rejectStatus[reason], errors.New("Session limit reached: "+reason))
+	}
+	released := false
+	defer func() {
+		if !released {
+			s.limiter.release(ip)
+		}
+	}()
 
-			log.Printf("Written %v bytes http response", n)
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		return caddyhttp.Error(http.StatusInternalServerError, errors.New("ResponseWriter does not implement Hijacker"))
+	}
 
-			// Pass the connection to handleConnection
-			go s.handleConnection(clientConn)
+	// In proxy mode, the upstream handshake is done first, so failures get a HTTP response
+	var (
+		u              *upstream
+		upstreamConn   net.Conn
+		upstreamReader *sstp.Reader
+	)
+	if s.proxy != nil {
+		var err error
+		u, upstreamConn, upstreamReader, err = s.proxy.connect(r.Context(), correlationID)
+		if err != nil {
+			s.log.Warn("Failed to connect to SSTP upstream", zap.String("remote", r.RemoteAddr), zap.String("correlation_id", correlationID), zap.Error(err))
+			return caddyhttp.Error(http.StatusBadGateway, err)
+		}
+	}
+	// Hijack connection
+	// The client may send its first packets straight after the request, and they may already be buffered
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		if upstreamConn != nil {
+			upstreamConn.Close()
+		}
+		return caddyhttp.Error(http.StatusInternalServerError, errors.New("failed to hijack: "+err.Error()))
+	}
+
+	_, err = clientConn.Write(s.handshakeResponse(time.Now()))
+	if err != nil {
+		clientConn.Close()
+		if upstreamConn != nil {
+			upstreamConn.Close()
+		}
+		s.log.Warn("Failed to send response", zap.String("remote", r.RemoteAddr), zap.Error(err))
+		return nil
+	}
 
-			return 0, nil
+	// Pass the connection to handleConnection, which releases the session once it has finished
+	hashes := s.sessionCertHashes(r, clientConn)
+	released = true
+	go func() {
+		defer s.limiter.release(ip)
+		if u != nil {
+			s.proxyConnection(clientConn, clientBuf.Reader, u, upstreamConn, upstreamReader, hashes, correlationID)
+			return
 		}
+		s.handleConnection(clientConn, clientBuf.Reader, hashes, correlationID)
+	}()
+	return nil
+}
+
+// Errors returned when validating SSTP handshake requests
+var (
+	ErrHandshakeHost          = errors.New("Host header missing")
+	ErrHandshakeCorrelationID = errors.New("SSTPCORRELATIONID header missing or not a GUID")
+	ErrHandshakeLength        = errors.New("Content-Length is not " + sstp.HandshakeContentLength)
+)
+
+// Reason a request is rejected by validateHandshake, used as the reason label of sstp_rejected_requests_total
+const rejectInvalidRequest = "invalid_request"
+
+// correlationIDPattern matches the GUID sent in SSTPCORRELATIONID, e.g. {62DFA5C0-E2E0-FD50-D286-B00F18B0C6F5}
+var correlationIDPattern = regexp.MustCompile(`^\{[0-9A-Fa-f]{8}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{4}-[0-9A-Fa-f]{12}\}$`)
+
+// validateHandshake checks the headers that MS-SSTP requires in the HTTP handshake
+func validateHandshake(r *http.Request, correlationID string) error {
+	if r.Host == "" {
+		return ErrHandshakeHost
+	}
+	if !correlationIDPattern.MatchString(correlationID) {
+		return ErrHandshakeCorrelationID
+	}
+	// The Listener rewrites the Content-Length of SSTP handshakes to the largest int64
+	if r.ContentLength != math.MaxInt64 {
+		return ErrHandshakeLength
+	}
+	return nil
+}
+
+// handshakeResponse builds the 200 response to a SSTP handshake, which is sent on the hijacked connection
+func (s *Server) handshakeResponse(now time.Time) []byte {
+	var b strings.Builder
+	b.WriteString("HTTP/1.1 200 OK\r\n")
+	b.WriteString("Date: " + now.UTC().Format(http.TimeFormat) + "\r\n")
+	if server := s.serverHeader(); server != "" {
+		b.WriteString("Server: " + server + "\r\n")
+	}
+	b.WriteString("Content-Length: " + sstp.HandshakeContentLength + "\r\n\r\n")
+	return []byte(b.String())
+}
+
+// serverHeader returns the Server header of the handshake response, or "" if it is hidden
+func (s *Server) serverHeader() string {
+	switch s.ServerHeader {
+	case "":
+		return DefaultServerHeader
+	case "off":
+		return ""
+	default:
+		return s.ServerHeader
+	}
+}
+
+// newPPPConnection starts the PPP connection of a session
+func (s *Server) newPPPConnection(config ppp.Config) (ppp.Connection, error) {
+	if s.PPPBackend != nil {
+		return s.PPPBackend(config)
+	}
+	conn, err := ppp.NewConnection(config)
+	if err != nil {
+		return nil, err
+	}
+	return *conn, nil
+}
+
+// sessionCertHashes returns the hashes of the certificate the client saw, for crypto binding.
+// If the certificate is unknown, no hashes are returned, so crypto binding fails.
+// It returns nil if the check is disabled with cert_hash off.
+func (s *Server) sessionCertHashes(r *http.Request, c net.Conn) certHashes {
+	if s.skipCertHash {
+		return nil
+	}
+	if s.certHashes != nil {
+		return s.certHashes
+	}
+	// The certificate may change as Caddy renews it, so the one served on this connection is hashed for each session
+	var certs [][]byte
+	if served, ok := c.(interface{ ServerCertificates() [][]byte }); ok {
+		certs = served.ServerCertificates()
+	} else if r.TLS != nil && len(r.TLS.LocalCertificate) > 0 {
+		certs = [][]byte{r.TLS.LocalCertificate[0]}
+	}
+	if len(certs) == 0 {
+		// e.g. TLS is offloaded, so the certificate must be pinned with cert_hash
+		s.log.Warn("Served certificate unknown, crypto binding will fail unless cert_hash is set", zap.String("remote", r.RemoteAddr))
+		return certHashes{}
+	}
+	hashes, err := newCertHashes(certs...)
+	if err != nil {
+		s.log.Warn("Failed to hash server certificate, crypto binding will fail", zap.Error(err))
+		return certHashes{}
 	}
-	log.Print("Got a request")
-	return s.NextHandler.ServeHTTP(w, r)
+	return hashes
 }
 
 type parseReturn struct {
@@ -82,59 +306,121 @@ type parseReturn struct {
 	Data      []byte
 }
 
-// Handles SSTP connection after HTTP 200 is sent
-func (s Server) handleConnection(c net.Conn) {
+// session is the state of a single SSTP connection
+type session struct {
+	// Data bytes received from and sent to the client, accessed atomically
+	bytesIn  uint64
+	bytesOut uint64
+
+	conn           net.Conn
+	pppConfig      ppp.Config
+	pppConnection  ppp.Connection
+	nonce          [32]byte
+	certHashes     certHashes
+	skipMAC        bool // Set by compound_mac off
+	connectRetries int
+	echoPending    bool
+	echoSent       time.Time // When the pending Echo Request was sent by the hello timer
+	state          serverState
+	teardownTimer  <-chan time.Time
+	abortTimeout   time.Duration
+	log            *zap.Logger
+
+	negotiationTimer <-chan time.Time // Aborts the session if the handshake isn't done in time
+
+	correlationID string // From the SSTPCORRELATIONID header of the handshake
+	upstream      string // The upstream address, if the session is proxied
+	newPPP        func(ppp.Config) (ppp.Connection, error)
+
+	handshakeDone    bool   // Set when Call Connected is verified
+	handshakeFailure string // Why the handshake failed, if the session ends before it is done
+
+	// Set by sessionTracker
+	id                string
+	started           time.Time
+	shutdown          chan struct{} // Closed when the session should be disconnected
+	shutdownSignalled bool
+	done              chan struct{} // Closed when the session has finished
+}
+
+// Handles SSTP connection after HTTP 200 is sent.
+// Packets are read from r, which must drain any bytes buffered before the connection was hijacked.
+func (s *Server) handleConnection(c net.Conn, r io.Reader, hashes certHashes, correlationID string) {
 	// Shut down the connection.
 	defer c.Close()
+	// A failure in one session must not take down the server
+	defer func() {
+		if err := recover(); err != nil {
+			s.log.Error("SSTP session failed", zap.Stringer("remote", c.RemoteAddr()), zap.String("correlation_id", correlationID), zap.Any("error", err), zap.ByteString("stack", debug.Stack()))
+		}
+	}()
 
 	// TODO: make more idiomatic, just copied straight from sstp-go
 
 	ch := make(chan parseReturn)
-	eCh := make(chan error)
+	eCh := make(chan error, 1)
+	// Closed when the session has finished, to stop the reader and writer goroutines
+	done := make(chan struct{})
+	defer close(done)
 
 	packChan := make(chan []byte)
-	var pppConnection ppp.Connection
-	pppConfig := ppp.Config{
-		DestIP:         s.destIP,
-		SrcIP:          s.srcIP,
-		ExtraArguments: s.extraArgs,
-		ConnectionType: ppp.ConnectionTypeTunTap,
-		DestWriter:     packetHandler{c, packChan},
+	sess := &session{
+		conn:             c,
+		correlationID:    correlationID,
+		state:            serverStateConnectRequestPending,
+		certHashes:       hashes,
+		skipMAC:          s.SkipCompoundMAC,
+		abortTimeout:     durationOrDefault(time.Duration(s.AbortTimeout), DefaultAbortTimeout),
+		negotiationTimer: time.After(durationOrDefault(time.Duration(s.NegotiationTimeout), DefaultNegotiationTimeout)),
+		pppConfig: ppp.Config{
+			DestIP:         s.destIP,
+			SrcIP:          s.srcIP,
+			ExtraArguments: s.Args,
+			ConnectionType: s.connectionType,
+			PppdPath:       s.PppdPath,
+			PppdOptions:    s.PppdOptions,
+			Observer:       metrics,
+		},
+		newPPP: s.newPPPConnection,
+	}
+	sess.pppConfig.DestWriter = packetHandler{c, packChan, done, &sess.bytesOut}
+	if !s.sessions.add(sess) {
+		s.log.Info("Server is shutting down, closing new connection", zap.Stringer("remote", c.RemoteAddr()), zap.String("correlation_id", correlationID))
+		return
 	}
+	sess.log = s.log.With(zap.String("session", sess.id), zap.Stringer("remote", c.RemoteAddr()), zap.String("correlation_id", correlationID))
+	sess.pppConfig.Logger = sess.log
+	sess.log.Info("Session started")
+	defer s.sessions.remove(sess)
+	metrics.sessionStarted()
+	defer metrics.sessionFinished()
+	defer func() {
+		if !sess.handshakeDone {
+			if sess.handshakeFailure == "" {
+				sess.handshakeFailure = handshakeClosed
+			}
+			metrics.handshake(sess.handshakeFailure)
+		}
+	}()
+	// Make sure no PPP connection (e.g. a pppd process) outlives the session
+	defer sess.closePPP()
 
 	// Start a goroutine to read from our net connection
+	reader := sstp.NewReader(r)
 	go func(ch chan parseReturn, eCh chan error) {
 		for {
 			// try to read the data
-			var data [4]byte
-			n, err := c.Read(data[:])
+			header, packet, err := reader.ReadPacket()
 			if err != nil {
 				// send an error if it's encountered
 				eCh <- err
 				return
 			}
-			if n < 4 {
-				eCh <- errors.New("Invalid packet")
-				return
-			}
-			isControl, lengthToRead, err := decodeHeader(data[:])
-			if err != nil {
-				// send an error if it's encountered
-				eCh <- err
-				return
-			}
-			newData := make([]byte, lengthToRead)
-			n, err = c.Read(newData)
-			if err != nil {
-				// send an error if it's encountered
-				eCh <- err
-				return
-			}
-			if n != lengthToRead {
-				eCh <- errors.New("Not all of packet read")
+			select {
+			case ch <- parseReturn{header.C, packet}:
+			case <-done:
 				return
 			}
-			ch <- parseReturn{isControl, newData}
 		}
 	}(ch, eCh)
 
@@ -143,43 +429,84 @@ func (s Server) handleConnection(c net.Conn) {
 			select {
 			case data := <-packChan: // This case means we recieved data on the connection
 				c.Write(data)
+			case <-done:
+				return
 			}
 		}
 	}(packChan)
 
-	//ticker := time.Tick(time.Second)
+	helloInterval := durationOrDefault(time.Duration(s.HelloInterval), DefaultHelloInterval)
+	helloTimer := time.NewTimer(helloInterval)
+	defer helloTimer.Stop()
+
 	// continuously read from the connection
 	for {
 		select {
 		case data := <-ch: // This case means we recieved data on the connection
+			// Any packet shows the client is alive, so restart the hello timer
+			if !helloTimer.Stop() {
+				select {
+				case <-helloTimer.C:
+				default:
+				}
+			}
+			helloTimer.Reset(helloInterval)
+			sess.echoPending = false
+
 			// Do something with the data
-			//log.Printf("%s\n", hex.Dump(data))
 			if data.isControl {
-				header := parseControl(data.Data)
-				newConn := handleControlPacket(header, c, pppConfig, pppConnection)
-				if newConn != nil {
-					pppConnection = *newConn
-				}
-			} else {
-				handleDataPacket(data.Data, c, pppConnection)
+				sess.handleControlPacket(data.Data)
+			} else if !sess.state.acceptsData() {
+				sess.log.Warn("Data packet not allowed, aborting connection", zap.Stringer("state", sess.state))
+				sess.abort(sstp.StatusInfo{Status: sstp.AttributeStatusUnacceptedFrameReceived})
+			} else if sess.state.forwardsData() {
+				atomic.AddUint64(&sess.bytesIn, uint64(len(data.Data)-sstp.HeaderLength))
+				metrics.dataReceived(len(data.Data) - sstp.HeaderLength)
+				sess.handleDataPacket(data.Data[sstp.HeaderLength:])
+			}
+			reader.Release(data.Data)
+			if sess.state.finished() {
+				return
 			}
 		case err := <-eCh: // This case means we got an error and the goroutine has finished
 			if err == io.EOF {
-				log.Print("Client disconnected")
-				if pppConnection != nil {
-					err = pppConnection.Close()
-					handleErr(err)
-				}
+				sess.log.Info("Client closed connection")
+			} else if isFramingError(err) {
+				// The stream can't be read any further, so abort without waiting for a reply
+				sess.log.Warn("Invalid packet received, aborting connection", zap.Error(err))
+				sess.handshakeFailed(handshakeInvalidMessage)
+				sess.sendMessage(&sstp.CallAbort{StatusInfos: []sstp.StatusInfo{{Status: sstp.AttributeStatusInvalidFrameReceived}}})
 			} else {
-				log.Fatalf("%s\n", err)
-				// handle our error then exit for loop
-				break
-				// This will timeout on the read.
-				//case <-ticker:
-				// do nothing? this is just so we can time out if we need to.
-				// you probably don't even need to have this here unless you want
-				// do something specifically on the timeout.
+				sess.log.Warn("Failed to read from client", zap.Error(err))
+			}
+			return
+		case <-helloTimer.C: // This case means the client has been idle for the hello interval
+			if sess.state.tearingDown() {
+				// The teardown timer will close the connection
+				continue
+			}
+			if sess.echoPending {
+				sess.log.Warn("No Echo Response received, aborting connection")
+				sess.handshakeFailed(handshakeTimeout)
+				sess.abort()
+				continue
+			}
+			sess.sendMessage(&sstp.EchoRequest{})
+			sess.echoPending = true
+			sess.echoSent = time.Now()
+			helloTimer.Reset(helloInterval)
+		case <-sess.shutdown: // This case means the server is shutting down, or the session was disconnected by an admin
+			sess.shutdown = nil
+			sess.stop()
+		case <-sess.negotiationTimer: // This case means the client didn't complete the handshake in time
+			sess.negotiationTimer = nil
+			if !sess.handshakeDone && !sess.state.tearingDown() {
+				sess.log.Warn("SSTP negotiation timed out, aborting connection", zap.Stringer("state", sess.state))
+				sess.handshakeFailed(handshakeTimeout)
+				sess.abort(sstp.StatusInfo{Status: sstp.AttributeStatusNegotiationTimeout})
 			}
+		case <-sess.teardownTimer: // This case means the client didn't respond to Call Abort or Call Disconnect in time
+			return
 		}
 	}
 }
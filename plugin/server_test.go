@@ -0,0 +1,978 @@
+package plugin_test
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/comp500/caddy-sstp/plugin"
+	"github.com/comp500/caddy-sstp/plugin/sstptest"
+	"github.com/comp500/caddy-sstp/sstp"
+)
+
+func TestHandshake(t *testing.T) {
+	h := sstptest.New(t, nil)
+	c := h.DialClient()
+	err := c.WriteRaw([]byte(sstptest.HandshakeRequest()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.ReadResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("Handshake status = %d, want %d", resp.StatusCode, http.StatusOK)
+	}
+	if length := resp.Header.Get("Content-Length"); length != sstp.HandshakeContentLength {
+		t.Errorf("Content-Length = %q, want %q", length, sstp.HandshakeContentLength)
+	}
+	if _, err := http.ParseTime(resp.Header.Get("Date")); err != nil {
+		t.Errorf("Invalid Date header: %s", err)
+	}
+
+	ack, err := c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.NextPPP()
+	connected, err := c.CallConnected(ack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WriteMessage(connected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The session is still up after crypto binding is verified
+	err = c.WriteMessage(&sstp.EchoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ExpectMessage(sstp.MessageTypeEchoResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDataBothWays(t *testing.T) {
+	h := sstptest.New(t, nil)
+	c := h.DialClient()
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := h.NextPPP()
+
+	sent := []byte{0xff, 0x03, 0x00, 0x21, 0x45}
+	err = c.WriteData(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err := f.Receive(sstptest.DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, sent) {
+		t.Errorf("PPP received %x, want %x", received, sent)
+	}
+
+	sent = []byte{0xff, 0x03, 0x00, 0x21, 0x46}
+	err = f.Send(sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	received, err = c.ReadData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, sent) {
+		t.Errorf("Client received %x, want %x", received, sent)
+	}
+}
+
+func TestDataSplitAcrossRecords(t *testing.T) {
+	h := sstptest.New(t, nil)
+	c := h.DialClient()
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := h.NextPPP()
+
+	sent := []byte{0xff, 0x03, 0x00, 0x21, 0x45, 0x00, 0x00, 0x14}
+	packet, err := sstp.AppendDataPacket(nil, sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Each write is a separate TLS record, and the first ends inside the SSTP header
+	for _, part := range [][]byte{packet[:3], packet[3:6], packet[6:]} {
+		err = c.WriteRaw(part)
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	received, err := f.Receive(sstptest.DefaultTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, sent) {
+		t.Errorf("PPP received %x, want %x", received, sent)
+	}
+}
+
+func TestEcho(t *testing.T) {
+	h := sstptest.New(t, nil)
+	c := h.DialClient()
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WriteMessage(&sstp.EchoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ExpectMessage(sstp.MessageTypeEchoResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHelloTimeout(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	h := sstptest.New(t, &plugin.Server{HelloInterval: caddy.Duration(interval)})
+	c := h.DialClient()
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := h.NextPPP()
+
+	// The server checks an idle client is alive
+	start := time.Now()
+	_, err = c.ExpectMessage(sstp.MessageTypeEchoRequest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < interval/2 {
+		t.Errorf("Echo Request sent after %s, want the hello interval %s", elapsed, interval)
+	}
+	// and aborts if it doesn't answer
+	expectAbort(t, c)
+	if !f.WaitClosed(sstptest.DefaultTimeout) {
+		t.Error("PPP connection not closed")
+	}
+}
+
+func TestHelloKeepsAlive(t *testing.T) {
+	const interval = 100 * time.Millisecond
+	h := sstptest.New(t, &plugin.Server{HelloInterval: caddy.Duration(interval)})
+	c := h.DialClient()
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := h.NextPPP()
+
+	// Answering each Echo Request keeps the session up for several hello intervals
+	for i := 0; i < 3; i++ {
+		_, err = c.ExpectMessage(sstp.MessageTypeEchoRequest)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = c.WriteMessage(&sstp.EchoResponse{})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = f.Send([]byte{0xff, 0x03, 0x00, 0x21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ReadData()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f.WaitClosed(0) {
+		t.Error("PPP connection closed")
+	}
+}
+
+func TestNegotiationTimeout(t *testing.T) {
+	h := sstptest.New(t, &plugin.Server{NegotiationTimeout: caddy.Duration(100 * time.Millisecond)})
+	c := h.DialClient()
+	err := c.Handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := h.NextPPP()
+
+	// The client never sends Call Connected
+	expectAbort(t, c, sstp.AttributeStatusNegotiationTimeout)
+	if !f.WaitClosed(sstptest.DefaultTimeout) {
+		t.Error("PPP connection not closed")
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	h := sstptest.New(t, nil)
+	c := h.DialClient()
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := h.NextPPP()
+	err = c.WriteMessage(&sstp.CallDisconnect{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ExpectMessage(sstp.MessageTypeCallDisconnectAck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.WaitClosed(sstptest.DefaultTimeout) {
+		t.Error("PPP connection not closed")
+	}
+}
+
+func TestServerDisconnect(t *testing.T) {
+	h := sstptest.New(t, nil)
+	c := h.DialClient()
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := h.NextPPP()
+	// Once the echo is answered, the server has handled Call Connected
+	err = c.WriteMessage(&sstp.EchoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ExpectMessage(sstp.MessageTypeEchoResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		h.Server.Cleanup()
+		close(done)
+	}()
+	_, err = c.ExpectMessage(sstp.MessageTypeCallDisconnect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WriteMessage(&sstp.CallDisconnectAck{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.WaitClosed(sstptest.DefaultTimeout) {
+		t.Error("PPP connection not closed")
+	}
+	select {
+	case <-done:
+	case <-time.After(sstptest.DefaultTimeout):
+		t.Error("Cleanup() didn't return after Call Disconnect Ack")
+	}
+}
+
+func TestInvalidHandshake(t *testing.T) {
+	handshake := func(host, length, correlationID string) string {
+		return fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\nContent-Length: %s\r\nSSTPCORRELATIONID: %s\r\n\r\n",
+			sstp.Method, sstp.RequestPath, host, length, correlationID)
+	}
+	tests := []struct {
+		name    string
+		request string
+	}{
+		{"missing correlation ID", fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\nContent-Length: %s\r\n\r\n",
+			sstp.Method, sstp.RequestPath, sstptest.ServerName, sstp.HandshakeContentLength)},
+		{"invalid correlation ID", handshake(sstptest.ServerName, sstp.HandshakeContentLength, "62DFA5C0-E2E0-FD50-D286-B00F18B0C6F5")},
+		{"wrong Content-Length", handshake(sstptest.ServerName, "0", sstptest.CorrelationID)},
+		{"empty Host", handshake("", sstp.HandshakeContentLength, sstptest.CorrelationID)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := sstptest.New(t, nil)
+			c := h.DialClient()
+			err := c.WriteRaw([]byte(tt.request))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := c.ReadResponse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != http.StatusBadRequest {
+				t.Errorf("Handshake status = %d, want %d", resp.StatusCode, http.StatusBadRequest)
+			}
+		})
+	}
+}
+
+func TestServerHeader(t *testing.T) {
+	tests := []struct {
+		config string
+		want   string
+	}{
+		{"", plugin.DefaultServerHeader},
+		{"off", ""},
+		{"caddy", "caddy"},
+	}
+	for _, tt := range tests {
+		h := sstptest.New(t, &plugin.Server{ServerHeader: tt.config})
+		c := h.DialClient()
+		err := c.WriteRaw([]byte(sstptest.HandshakeRequest()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := c.ReadResponse()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := resp.Header.Get("Server"); got != tt.want {
+			t.Errorf("ServerHeader %q: Server = %q, want %q", tt.config, got, tt.want)
+		}
+	}
+}
+
+func TestFallThrough(t *testing.T) {
+	tests := []struct {
+		name    string
+		request string
+	}{
+		{"GET", "GET / HTTP/1.1\r\nHost: " + sstptest.ServerName + "\r\n\r\n"},
+		{"other path", sstp.Method + " /other HTTP/1.1\r\nHost: " + sstptest.ServerName + "\r\nContent-Length: 0\r\n\r\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := sstptest.New(t, nil)
+			c := h.DialClient()
+			err := c.WriteRaw([]byte(tt.request))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := c.ReadResponse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != sstptest.NextStatus {
+				t.Errorf("Status = %d, want %d from the next handler", resp.StatusCode, sstptest.NextStatus)
+			}
+		})
+	}
+}
+
+func TestCompoundMACWrongHLAK(t *testing.T) {
+	h := sstptest.New(t, nil)
+	c := h.DialClient()
+	c.HLAK = make([]byte, 32)
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ExpectMessage(sstp.MessageTypeCallAbort)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCompoundMACWithoutKeyExport(t *testing.T) {
+	h := sstptest.New(t, nil)
+	h.WithoutKeyExport()
+	c := h.DialClient()
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectAbort(t, c, sstp.AttributeStatusInvalidFrameReceived)
+}
+
+func TestCompoundMACOff(t *testing.T) {
+	h := sstptest.New(t, &plugin.Server{SkipCompoundMAC: true})
+	h.WithoutKeyExport()
+	c := h.DialClient()
+	c.HLAK = nil
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WriteMessage(&sstp.EchoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ExpectMessage(sstp.MessageTypeEchoResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCryptoBindingResumedSession(t *testing.T) {
+	h := sstptest.New(t, nil)
+	config := h.TLSConfig()
+	config.ClientSessionCache = tls.NewLRUClientSessionCache(1)
+	for i := 0; i < 2; i++ {
+		conn, err := tls.Dial("tcp", h.Addr(), config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// The server doesn't send its certificate again in a resumed handshake
+		if resumed := conn.ConnectionState().DidResume; resumed != (i == 1) {
+			t.Fatalf("Connection %d resumed = %t", i, resumed)
+		}
+		c := &sstptest.Client{Conn: conn, HLAK: h.HLAK, Timeout: sstptest.DefaultTimeout}
+		err = c.Establish()
+		if err != nil {
+			t.Fatal(err)
+		}
+		h.NextPPP()
+		err = c.WriteMessage(&sstp.EchoRequest{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = c.ExpectMessage(sstp.MessageTypeEchoResponse)
+		if err != nil {
+			t.Fatalf("Connection %d: %s", i, err)
+		}
+		conn.Close()
+	}
+}
+
+func TestIllegalMessageAborts(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(c *sstptest.Client) error
+		send  func(c *sstptest.Client) error
+	}{
+		{"echo before connect request", (*sstptest.Client).Handshake, func(c *sstptest.Client) error {
+			return c.WriteMessage(&sstp.EchoRequest{})
+		}},
+		{"data before connect request", (*sstptest.Client).Handshake, func(c *sstptest.Client) error {
+			return c.WriteData([]byte{0xff, 0x03})
+		}},
+		{"second connect request", func(c *sstptest.Client) error {
+			err := c.Handshake()
+			if err != nil {
+				return err
+			}
+			_, err = c.Connect()
+			return err
+		}, func(c *sstptest.Client) error {
+			return c.WriteMessage(&sstp.CallConnectRequest{ProtocolID: sstp.EncapsulatedProtocolIDPPP})
+		}},
+		{"second call connected", (*sstptest.Client).Establish, func(c *sstptest.Client) error {
+			return c.WriteMessage(&sstp.CallConnected{CryptoBinding: sstp.CryptoBinding{HashProtocol: sstp.HashProtocolSHA256}})
+		}},
+		{"connect ack from client", (*sstptest.Client).Establish, func(c *sstptest.Client) error {
+			return c.WriteMessage(&sstp.CallConnectAck{CryptoBindingReq: sstp.CryptoBindingReq{HashProtocols: sstp.HashProtocolSHA256}})
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := sstptest.New(t, nil)
+			c := h.DialClient()
+			err := tt.setup(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = tt.send(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			message, err := c.ExpectMessage(sstp.MessageTypeCallAbort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			statusInfos := message.(*sstp.CallAbort).StatusInfos
+			if len(statusInfos) != 1 || statusInfos[0].Status != sstp.AttributeStatusUnacceptedFrameReceived {
+				t.Errorf("Call Abort status = %v, want %s", statusInfos, sstp.AttributeStatusUnacceptedFrameReceived)
+			}
+		})
+	}
+}
+
+func TestClientAbortIsAnswered(t *testing.T) {
+	tests := []struct {
+		name  string
+		setup func(c *sstptest.Client) error
+	}{
+		{"call connected pending", func(c *sstptest.Client) error {
+			err := c.Handshake()
+			if err != nil {
+				return err
+			}
+			_, err = c.Connect()
+			return err
+		}},
+		{"call connected", (*sstptest.Client).Establish},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := sstptest.New(t, nil)
+			c := h.DialClient()
+			err := tt.setup(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f := h.NextPPP()
+			err = c.WriteMessage(&sstp.CallAbort{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = c.ExpectMessage(sstp.MessageTypeCallAbort)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !f.WaitClosed(sstptest.DefaultTimeout) {
+				t.Error("PPP connection not closed")
+			}
+		})
+	}
+}
+
+func TestClientConnectedAfterPPP(t *testing.T) {
+	h := sstptest.New(t, nil)
+	conn, err := sstp.Dial("tcp", h.Addr(), &sstp.ClientConfig{TLSConfig: h.TLSConfig(), Host: sstptest.ServerName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	f := h.NextPPP()
+
+	// PPP authentication runs before Call Connected
+	_, err = conn.Write([]byte{0xff, 0x03, 0xc0, 0x21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Receive(sstptest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+	err = f.Send([]byte{0xff, 0x03, 0xc2, 0x23})
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	n, err := conn.Read(buf)
+	if err != nil || n != 4 {
+		t.Fatalf("Read() = %d, %v", n, err)
+	}
+
+	err = conn.Connected(h.HLAK)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Connected(h.HLAK); err != sstp.ErrConnected {
+		t.Errorf("Second Connected() error = %v, want %v", err, sstp.ErrConnected)
+	}
+	_, err = conn.Write([]byte{0xff, 0x03, 0x00, 0x21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Receive(sstptest.DefaultTimeout); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestClientConnectedWrongHLAK(t *testing.T) {
+	h := sstptest.New(t, nil)
+	conn, err := sstp.Dial("tcp", h.Addr(), &sstp.ClientConfig{TLSConfig: h.TLSConfig(), Host: sstptest.ServerName})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = conn.Connected(make([]byte, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = conn.Read(make([]byte, 16))
+	if err != sstp.ErrAborted {
+		t.Errorf("Read() error = %v, want %v", err, sstp.ErrAborted)
+	}
+}
+
+func TestPipelinedCallConnectRequest(t *testing.T) {
+	h := sstptest.New(t, nil)
+	c := h.DialClient()
+	request, err := (&sstp.CallConnectRequest{ProtocolID: sstp.EncapsulatedProtocolIDPPP}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The Call Connect Request arrives in the same write as the handshake, before the response is sent
+	err = c.WriteRaw(append([]byte(sstptest.HandshakeRequest()), request...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := c.ReadResponse()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("Handshake status = %d, want 200", resp.StatusCode)
+	}
+	ack, err := c.ExpectMessage(sstp.MessageTypeCallConnectAck)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connected, err := c.CallConnected(ack.(*sstp.CallConnectAck))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WriteMessage(connected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WriteMessage(&sstp.EchoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ExpectMessage(sstp.MessageTypeEchoResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// expectNak sends a Call Connect Request for an unsupported protocol, and checks that the server lists PPP in its Nak
+func expectNak(t *testing.T, c *sstptest.Client) {
+	t.Helper()
+	err := c.WriteMessage(&sstp.CallConnectRequest{ProtocolID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	message, err := c.ExpectMessage(sstp.MessageTypeCallConnectNak)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statusInfos := message.(*sstp.CallConnectNak).StatusInfos
+	if len(statusInfos) != 1 {
+		t.Fatalf("Call Connect Nak status = %v, want one StatusInfo", statusInfos)
+	}
+	info := statusInfos[0]
+	if info.AttribID != sstp.AttributeIDEncapsulatedProtocolID || info.Status != sstp.AttributeStatusValueNotSupported {
+		t.Errorf("Call Connect Nak status = %v, want %s (%s)", info, sstp.AttributeStatusValueNotSupported, sstp.AttributeIDEncapsulatedProtocolID)
+	}
+	if want := []byte{0, byte(sstp.EncapsulatedProtocolIDPPP)}; !bytes.Equal(info.Value, want) {
+		t.Errorf("Call Connect Nak lists protocols %x, want %x", info.Value, want)
+	}
+}
+
+func TestConnectNakThenRetry(t *testing.T) {
+	h := sstptest.New(t, nil)
+	c := h.DialClient()
+	err := c.Handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectNak(t, c)
+
+	// A valid retry is accepted
+	ack, err := c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.NextPPP()
+	connected, err := c.CallConnected(ack)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WriteMessage(connected)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WriteMessage(&sstp.EchoRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.ExpectMessage(sstp.MessageTypeEchoResponse)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestConnectRetryCountExceeded(t *testing.T) {
+	h := sstptest.New(t, nil)
+	c := h.DialClient()
+	err := c.Handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		expectNak(t, c)
+	}
+
+	err = c.WriteMessage(&sstp.CallConnectRequest{ProtocolID: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectAbort(t, c, sstp.AttributeStatusRetryCountExceeded)
+}
+
+// expectAbort reads the Call Abort sent by the server, checking its status if one is given
+func expectAbort(t *testing.T, c *sstptest.Client, status ...sstp.AttributeStatus) {
+	t.Helper()
+	message, err := c.ExpectMessage(sstp.MessageTypeCallAbort)
+	if err != nil {
+		t.Fatal(err)
+	}
+	statusInfos := message.(*sstp.CallAbort).StatusInfos
+	if len(statusInfos) != len(status) {
+		t.Fatalf("Call Abort status = %v, want %v", statusInfos, status)
+	}
+	for i := range status {
+		if statusInfos[i].Status != status[i] {
+			t.Errorf("Call Abort status = %v, want %v", statusInfos, status)
+		}
+	}
+}
+
+func TestNonceFailure(t *testing.T) {
+	restore := plugin.SetNonceSource(func() ([32]byte, error) {
+		return [32]byte{}, errors.New("no randomness")
+	})
+	t.Cleanup(restore)
+	h := sstptest.New(t, nil)
+	c := h.DialClient()
+	err := c.Handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WriteMessage(&sstp.CallConnectRequest{ProtocolID: sstp.EncapsulatedProtocolIDPPP})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectAbort(t, c)
+}
+
+func TestPPPStartFailure(t *testing.T) {
+	h := sstptest.New(t, nil)
+	h.FailPPPStart(errors.New("no pppd"))
+	c := h.DialClient()
+	err := c.Handshake()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = c.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectAbort(t, c)
+}
+
+func TestPPPWriteFailure(t *testing.T) {
+	h := sstptest.New(t, nil)
+	c := h.DialClient()
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := h.NextPPP()
+	f.FailWrites(errors.New("pppd exited"))
+	err = c.WriteData([]byte{0xff, 0x03, 0x00, 0x21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectAbort(t, c)
+	if !f.WaitClosed(sstptest.DefaultTimeout) {
+		t.Error("PPP connection not closed")
+	}
+}
+
+func TestFramingError(t *testing.T) {
+	h := sstptest.New(t, nil)
+	c := h.DialClient()
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := h.NextPPP()
+	// SSTP version 2.0
+	err = c.WriteRaw([]byte{0x20, 0x00, 0x00, 0x08, 0xff, 0x03, 0x00, 0x21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectAbort(t, c, sstp.AttributeStatusInvalidFrameReceived)
+	// The stream can't be read any further, so the server doesn't wait for a reply
+	if _, _, err := c.ReadPacket(); err == nil {
+		t.Error("Connection not closed after framing error")
+	}
+	if !f.WaitClosed(sstptest.DefaultTimeout) {
+		t.Error("PPP connection not closed")
+	}
+}
+
+func TestSessionPanicRecovered(t *testing.T) {
+	h := sstptest.New(t, nil)
+	c := h.DialClient()
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := h.NextPPP()
+	f.PanicOnWrite()
+	err = c.WriteData([]byte{0xff, 0x03, 0x00, 0x21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := c.ReadPacket(); err == nil {
+		t.Error("Connection not closed after panic")
+	}
+	if !f.WaitClosed(sstptest.DefaultTimeout) {
+		t.Error("PPP connection not closed")
+	}
+
+	// Other sessions are unaffected
+	conn, err := h.Dial()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+}
+
+func TestSessionLimits(t *testing.T) {
+	tests := []struct {
+		name       string
+		limits     *plugin.LimitsConfig
+		status     int
+		retryAfter string
+	}{
+		{"max sessions", &plugin.LimitsConfig{MaxSessions: 1}, http.StatusServiceUnavailable, ""},
+		{"max sessions per IP", &plugin.LimitsConfig{MaxSessionsPerIP: 1}, http.StatusTooManyRequests, ""},
+		{"handshake rate", &plugin.LimitsConfig{HandshakeRate: 1, HandshakeInterval: caddy.Duration(time.Minute)}, http.StatusTooManyRequests, "60"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := sstptest.New(t, &plugin.Server{Limits: tt.limits})
+			// The first session is counted once its handshake is answered
+			err := h.DialClient().Handshake()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			c := h.DialClient()
+			err = c.WriteRaw([]byte(sstptest.HandshakeRequest()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := c.ReadResponse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("Handshake status = %d, want %d", resp.StatusCode, tt.status)
+			}
+			if retryAfter := resp.Header.Get("Retry-After"); retryAfter != tt.retryAfter {
+				t.Errorf("Retry-After = %q, want %q", retryAfter, tt.retryAfter)
+			}
+		})
+	}
+}
+
+func TestAccessDenied(t *testing.T) {
+	tests := []struct {
+		name   string
+		forbid bool
+		status int
+	}{
+		{"fall through", false, sstptest.NextStatus},
+		{"forbid", true, http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// The deny rule wins over the allow rule that also matches the client
+			access := &plugin.AccessConfig{Allow: []string{"127.0.0.0/8"}, Deny: []string{"127.0.0.1"}, Forbid: tt.forbid}
+			h := sstptest.New(t, &plugin.Server{Access: access})
+			c := h.DialClient()
+			err := c.WriteRaw([]byte(sstptest.HandshakeRequest()))
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp, err := c.ReadResponse()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.status {
+				t.Errorf("Handshake status = %d, want %d", resp.StatusCode, tt.status)
+			}
+		})
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	// A trailing slash on the configured path still serves the list without one
+	h := sstptest.New(t, &plugin.Server{DestIP: "10.0.0.2", Admin: &plugin.AdminConfig{Path: "/sstp-admin/"}})
+	c := h.DialClient()
+	err := c.Establish()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := h.NextPPP()
+
+	client := &http.Client{Transport: &http.Transport{TLSClientConfig: h.TLSConfig()}}
+	defer client.CloseIdleConnections()
+	base := "https://" + h.Addr() + "/sstp-admin"
+	request := func(method, url string, want int, v interface{}) {
+		t.Helper()
+		req, err := http.NewRequest(method, url, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != want {
+			t.Fatalf("%s %s status = %d, want %d", method, url, resp.StatusCode, want)
+		}
+		if v != nil {
+			if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	var sessions []struct {
+		ID            string `json:"id"`
+		CorrelationID string `json:"correlation_id"`
+	}
+	request(http.MethodGet, base, http.StatusOK, &sessions)
+	if len(sessions) != 1 || sessions[0].CorrelationID != sstptest.CorrelationID {
+		t.Fatalf("Sessions = %+v, want the connected session", sessions)
+	}
+	request(http.MethodGet, base+"/", http.StatusOK, nil)
+	id := sessions[0].ID
+
+	var session struct {
+		ID               string `json:"id"`
+		ConfiguredDestIP string `json:"configured_dest_ip"`
+	}
+	request(http.MethodGet, base+"/"+id, http.StatusOK, &session)
+	if session.ID != id || session.ConfiguredDestIP != "10.0.0.2" {
+		t.Errorf("Session = %+v, want ID %q and the configured dest_ip", session, id)
+	}
+	request(http.MethodGet, base+"/unknown", http.StatusNotFound, nil)
+	request(http.MethodPost, base, http.StatusMethodNotAllowed, nil)
+
+	request(http.MethodDelete, base+"/"+id, http.StatusAccepted, nil)
+	_, err = c.ExpectMessage(sstp.MessageTypeCallDisconnect)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = c.WriteMessage(&sstp.CallDisconnectAck{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !f.WaitClosed(sstptest.DefaultTimeout) {
+		t.Error("PPP connection not closed")
+	}
+	request(http.MethodDelete, base+"/unknown", http.StatusNotFound, nil)
+}
@@ -0,0 +1,204 @@
+package plugin
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// sessionTracker tracks the running sessions of a Server, so they can be inspected and disconnected
+type sessionTracker struct {
+	lock     sync.Mutex
+	sessions map[string]*session
+	closing  bool
+	log      *zap.Logger
+}
+
+func newSessionTracker(log *zap.Logger) *sessionTracker {
+	return &sessionTracker{sessions: make(map[string]*session), log: log}
+}
+
+// sessionInfo describes a session, for the admin endpoint
+type sessionInfo struct {
+	ID             string    `json:"id"`
+	RemoteAddr     string    `json:"remote_addr"`
+	CorrelationID  string    `json:"correlation_id"`
+	Upstream       string    `json:"upstream,omitempty"`
+	Started        time.Time `json:"started"`
+	ConnectionType string    `json:"connection_type"`
+	// The addresses set by src_ip and dest_ip. These are the configured addresses, not those IPCP negotiated,
+	// which may differ, e.g. when pppd assigns them.
+	ConfiguredSrcIP  net.IP `json:"configured_src_ip,omitempty"`
+	ConfiguredDestIP net.IP `json:"configured_dest_ip,omitempty"`
+	BytesIn          uint64 `json:"bytes_in"`
+	BytesOut         uint64 `json:"bytes_out"`
+}
+
+func (s *session) info() sessionInfo {
+	if s.upstream != "" {
+		// Proxied sessions have no local PPP connection
+		return sessionInfo{
+			ID:             s.id,
+			RemoteAddr:     s.conn.RemoteAddr().String(),
+			CorrelationID:  s.correlationID,
+			Upstream:       s.upstream,
+			Started:        s.started,
+			ConnectionType: "proxy",
+			BytesIn:        atomic.LoadUint64(&s.bytesIn),
+			BytesOut:       atomic.LoadUint64(&s.bytesOut),
+		}
+	}
+	return sessionInfo{
+		ID:               s.id,
+		RemoteAddr:       s.conn.RemoteAddr().String(),
+		CorrelationID:    s.correlationID,
+		Started:          s.started,
+		ConnectionType:   s.pppConfig.ConnectionType.String(),
+		ConfiguredSrcIP:  s.pppConfig.SrcIP,
+		ConfiguredDestIP: s.pppConfig.DestIP,
+		BytesIn:          atomic.LoadUint64(&s.bytesIn),
+		BytesOut:         atomic.LoadUint64(&s.bytesOut),
+	}
+}
+
+func newSessionID() string {
+	var b [8]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		// Fall back to the time, which is unique enough to identify a session
+		return strconv.FormatInt(time.Now().UnixNano(), 16)
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// add starts tracking a session. It returns false if the server is shutting down.
+func (t *sessionTracker) add(s *session) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.closing {
+		return false
+	}
+	s.id = newSessionID()
+	for t.sessions[s.id] != nil {
+		s.id = newSessionID()
+	}
+	s.started = time.Now()
+	s.shutdown = make(chan struct{})
+	s.done = make(chan struct{})
+	t.sessions[s.id] = s
+	return true
+}
+
+// remove stops tracking a session, once it has finished
+func (t *sessionTracker) remove(s *session) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	if t.sessions[s.id] == s {
+		delete(t.sessions, s.id)
+		close(s.done)
+	}
+}
+
+// list returns the details of every session, oldest first
+func (t *sessionTracker) list() []sessionInfo {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	infos := make([]sessionInfo, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		infos = append(infos, s.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].Started.Before(infos[j].Started)
+	})
+	return infos
+}
+
+// get returns the details of a session
+func (t *sessionTracker) get(id string) (sessionInfo, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s, ok := t.sessions[id]
+	if !ok {
+		return sessionInfo{}, false
+	}
+	return s.info(), true
+}
+
+// disconnect asks a session to disconnect, returning false if it doesn't exist
+func (t *sessionTracker) disconnect(id string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	s, ok := t.sessions[id]
+	if !ok {
+		return false
+	}
+	s.signalShutdown()
+	return true
+}
+
+// signalShutdown asks the session to disconnect. The tracker's lock must be held.
+func (s *session) signalShutdown() {
+	if !s.shutdownSignalled {
+		s.shutdownSignalled = true
+		close(s.shutdown)
+	}
+}
+
+// isClosing returns true if the server is shutting down, and new sessions won't be accepted
+func (t *sessionTracker) isClosing() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	return t.closing
+}
+
+// disconnectAll disconnects every session, and waits until they have finished.
+// Sessions that don't finish within the timeout are closed.
+// If final is true, new sessions are rejected.
+func (t *sessionTracker) disconnectAll(timeout time.Duration, final bool) {
+	t.lock.Lock()
+	if final {
+		t.closing = true
+	}
+	sessions := make([]*session, 0, len(t.sessions))
+	for _, s := range t.sessions {
+		sessions = append(sessions, s)
+		s.signalShutdown()
+	}
+	t.lock.Unlock()
+
+	if len(sessions) == 0 {
+		return
+	}
+	t.log.Info("Disconnecting SSTP sessions", zap.Int("count", len(sessions)))
+	if waitSessions(sessions, timeout) {
+		return
+	}
+
+	t.log.Warn("SSTP sessions didn't disconnect in time, closing connections")
+	for _, s := range sessions {
+		s.conn.Close()
+	}
+	if !waitSessions(sessions, timeout) {
+		t.log.Error("SSTP sessions didn't finish after closing connections")
+	}
+}
+
+// waitSessions waits for the sessions to finish, returning false if the timeout expired first
+func waitSessions(sessions []*session, timeout time.Duration) bool {
+	deadline := time.After(timeout)
+	for _, s := range sessions {
+		select {
+		case <-s.done:
+		case <-deadline:
+			return false
+		}
+	}
+	return true
+}
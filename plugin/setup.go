@@ -1,64 +1,619 @@
 // Package plugin is a Caddy HTTP plugin that implements the SSTP protocol.
 // This requires pppd to bridge the connection through SSTP.
+//
+// The plugin provides two modules: the http.handlers.sstp handler, and the caddy.listeners.sstp listener wrapper,
+// which must be configured after the tls listener wrapper.
 package plugin
 
 import (
+	"errors"
+	"fmt"
 	"net"
+	"strconv"
+	"strings"
+	"time"
 
-	"github.com/caddyserver/caddy"
-	"github.com/caddyserver/caddy/caddyhttp/httpserver"
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+	"github.com/caddyserver/caddy/v2/caddyconfig/httpcaddyfile"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/comp500/caddy-sstp/ppp"
 )
 
 func init() {
-	caddy.RegisterPlugin("sstp", caddy.Plugin{
-		ServerType: "http",
-		Action:     setup,
-	})
+	caddy.RegisterModule(Server{})
+	caddy.RegisterModule(ListenerWrapper{})
+	httpcaddyfile.RegisterHandlerDirective("sstp", parseCaddyfile)
+	httpcaddyfile.RegisterDirectiveOrder("sstp", httpcaddyfile.Before, "reverse_proxy")
 }
 
-func setup(c *caddy.Controller) error {
-	server := &Server{}
+// CaddyModule returns the Caddy module information.
+func (Server) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "http.handlers.sstp",
+		New: func() caddy.Module { return new(Server) },
+	}
+}
+
+// CaddyModule returns the Caddy module information.
+func (ListenerWrapper) CaddyModule() caddy.ModuleInfo {
+	return caddy.ModuleInfo{
+		ID:  "caddy.listeners.sstp",
+		New: func() caddy.Module { return new(ListenerWrapper) },
+	}
+}
+
+// Provision sets up the server from its configuration.
+func (s *Server) Provision(ctx caddy.Context) error {
+	log, err := withLogLevel(ctx.Logger(), s.LogLevel)
+	if err != nil {
+		return fmt.Errorf("log_level: %s", err)
+	}
+	s.log = log
+
+	if err := metrics.register(ctx.GetMetricsRegistry()); err != nil {
+		return fmt.Errorf("Failed to register metrics: %s", err)
+	}
+
+	if s.SrcIP != "" {
+		s.srcIP = net.ParseIP(s.SrcIP)
+		if s.srcIP == nil {
+			return fmt.Errorf("src_ip: invalid IP address %q", s.SrcIP)
+		}
+	}
+	if s.DestIP != "" {
+		s.destIP = net.ParseIP(s.DestIP)
+		if s.destIP == nil {
+			return fmt.Errorf("dest_ip: invalid IP address %q", s.DestIP)
+		}
+	}
+	if s.Backend != "" {
+		connectionType, ok := backends[strings.ToLower(s.Backend)]
+		if !ok {
+			return fmt.Errorf("backend: unknown backend %q, expected pppd, tuntap or vnat", s.Backend)
+		}
+		s.connectionType = connectionType
+	}
+
+	if s.Admin != nil {
+		allow := s.Admin.Allow
+		if len(allow) == 0 {
+			allow = defaultAdminAllow
+		}
+		networks, err := parseCIDRs(allow)
+		if err != nil {
+			return fmt.Errorf("admin: invalid network: %s", err)
+		}
+		s.admin = adminConfig{path: s.Admin.Path, allow: networks}
+	}
+	access, err := newAccessRules(s.Access)
+	if err != nil {
+		return fmt.Errorf("access: %s", err)
+	}
+	s.access = access
+
+	if s.CertHash != nil {
+		hashes, err := s.CertHash.hashes()
+		if err != nil {
+			return fmt.Errorf("cert_hash: %s", err)
+		}
+		s.certHashes = hashes
+		s.skipCertHash = s.CertHash.Off
+	}
+	if s.SkipCompoundMAC {
+		s.log.Warn("Crypto binding compound MAC is not checked, so sessions aren't protected from man-in-the-middle attacks")
+	}
+
+	s.sessions = newSessionTracker(s.log)
+	s.limiter = newSessionLimiter(s.Limits)
+
+	if s.Proxy != nil {
+		p, err := newProxy(s.Proxy, s.log)
+		if err != nil {
+			return fmt.Errorf("proxy: %s", err)
+		}
+		p.certHashes = s.certHashes
+		p.skipCertHash = s.skipCertHash
+		s.proxy = p
+		s.proxy.start()
+	}
+	return nil
+}
+
+// Validate checks the configuration.
+func (s *Server) Validate() error {
+	for name, d := range map[string]caddy.Duration{
+		"hello_interval":      s.HelloInterval,
+		"negotiation_timeout": s.NegotiationTimeout,
+		"abort_timeout":       s.AbortTimeout,
+	} {
+		if d < 0 {
+			return fmt.Errorf("%s: duration %s must be positive", name, time.Duration(d))
+		}
+	}
+	if s.Path != "" && !strings.HasPrefix(s.Path, "/") {
+		return fmt.Errorf("path: request path %q must start with /", s.Path)
+	}
+	if s.Limits != nil {
+		if s.Limits.MaxSessions < 0 || s.Limits.MaxSessionsPerIP < 0 || s.Limits.HandshakeRate < 0 {
+			return errors.New("limits: limits must not be negative")
+		}
+		if s.Limits.HandshakeInterval < 0 {
+			return fmt.Errorf("limits: duration %s must be positive", time.Duration(s.Limits.HandshakeInterval))
+		}
+	}
+	if s.Proxy != nil {
+		if len(s.Proxy.Upstreams) == 0 {
+			return errors.New("proxy: no upstreams")
+		}
+		for name, d := range map[string]caddy.Duration{
+			"dial_timeout":    s.Proxy.DialTimeout,
+			"health_interval": s.Proxy.HealthInterval,
+			"health_timeout":  s.Proxy.HealthTimeout,
+		} {
+			if d < 0 {
+				return fmt.Errorf("proxy: %s: duration %s must be positive", name, time.Duration(d))
+			}
+		}
+	}
+	if strings.ContainsAny(s.ServerHeader, "\r\n") {
+		return errors.New("server_header: must not contain line breaks")
+	}
+	if s.Admin != nil && s.Admin.Path == "" {
+		return errors.New("admin: path is required")
+	}
+	// pppd doesn't export the HLAK, so its sessions would all fail crypto binding
+	if s.connectionType == ppp.ConnectionTypePppd && s.PPPBackend == nil && s.Proxy == nil && !s.SkipCompoundMAC {
+		return errors.New("backend: pppd can't export the HLAK to check the crypto binding compound MAC, " +
+			"use compound_mac off to accept sessions without checking it")
+	}
+	return nil
+}
+
+// Cleanup disconnects the server's sessions, when the config is reloaded or Caddy stops.
+// Sessions that don't acknowledge in time are closed after another abort timeout.
+func (s *Server) Cleanup() error {
+	if s.proxy != nil {
+		s.proxy.close()
+	}
+	if s.sessions == nil {
+		return nil
+	}
+	shutdownTimeout := 2 * durationOrDefault(time.Duration(s.AbortTimeout), DefaultAbortTimeout)
+	s.sessions.disconnectAll(shutdownTimeout, true)
+	return nil
+}
+
+// Provision sets up the listener wrapper from its configuration.
+func (lw *ListenerWrapper) Provision(ctx caddy.Context) error {
+	log, err := withLogLevel(ctx.Logger(), lw.LogLevel)
+	if err != nil {
+		return fmt.Errorf("log_level: %s", err)
+	}
+	lw.log = log
+
+	if lw.ProxyProtocol != nil {
+		if len(lw.ProxyProtocol.Trusted) == 0 {
+			return errors.New("proxy_protocol: no trusted networks")
+		}
+		trusted, err := parseCIDRs(lw.ProxyProtocol.Trusted)
+		if err != nil {
+			return fmt.Errorf("proxy_protocol: invalid network: %s", err)
+		}
+		lw.proxyTrusted = trusted
+	}
+	return nil
+}
+
+// parseCaddyfile sets up the handler from the sstp directive
+func parseCaddyfile(h httpcaddyfile.Helper) (caddyhttp.MiddlewareHandler, error) {
+	s := new(Server)
+	err := s.UnmarshalCaddyfile(h.Dispenser)
+	return s, err
+}
 
-	for c.Next() { // skip the directive name
-		for c.NextBlock() {
-			directive := c.Val()
-			args := c.RemainingArgs()
+// UnmarshalCaddyfile sets up the handler from Caddyfile tokens. Syntax:
+//
+//	sstp {
+//		src_ip <ip>
+//		dest_ip <ip>
+//		args <pppd arguments...>
+//		backend pppd|tuntap|vnat
+//		pppd_path <path>
+//		pppd_options <file>
+//		hello_interval <duration>
+//		negotiation_timeout <duration>
+//		abort_timeout <duration>
+//		path <request path>
+//		admin <path> [allowed networks...]
+//		log_level debug|info|warn|error
+//		server_header <value>|off
+//		cert_hash <pem file> | sha1|sha256 <hex hash> | off
+//		compound_mac off
+//		max_sessions <n>
+//		max_sessions_per_ip <n>
+//		handshake_rate <n> [interval]
+//		allow <networks...>
+//		deny <networks...>
+//		denied next|forbid
+//		proxy <upstreams...> {
+//			lb_policy round_robin|random|least_conn
+//			dial_timeout <duration>
+//			health_interval <duration>
+//			health_timeout <duration>
+//			tls_server_name <name>
+//			tls_ca <pem file>
+//			tls_insecure_skip_verify
+//		}
+//	}
+func (s *Server) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() { // skip the directive name
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			directive := d.Val()
+			args := d.RemainingArgs()
 			switch directive {
 			case "args":
-				server.extraArgs = args
+				s.Args = args
 			case "src_ip":
+				if err := parseIPArg(d, directive, args); err != nil {
+					return err
+				}
+				s.SrcIP = args[0]
+			case "dest_ip":
+				if err := parseIPArg(d, directive, args); err != nil {
+					return err
+				}
+				s.DestIP = args[0]
+			case "hello_interval":
+				interval, err := parseDurationArg(d, directive, args)
+				if err != nil {
+					return err
+				}
+				s.HelloInterval = caddy.Duration(interval)
+			case "negotiation_timeout":
+				timeout, err := parseDurationArg(d, directive, args)
+				if err != nil {
+					return err
+				}
+				s.NegotiationTimeout = caddy.Duration(timeout)
+			case "abort_timeout":
+				timeout, err := parseDurationArg(d, directive, args)
+				if err != nil {
+					return err
+				}
+				s.AbortTimeout = caddy.Duration(timeout)
+			case "backend":
 				if len(args) != 1 {
-					return c.ArgErr()
+					return argCountErr(d, directive, "1 argument", args)
 				}
-				server.srcIP = net.ParseIP(args[0])
-				if server.srcIP == nil { // parsing failed
-					return c.ArgErr()
+				if _, ok := backends[strings.ToLower(args[0])]; !ok {
+					return d.Errf("%s: unknown backend %q, expected pppd, tuntap or vnat", directive, args[0])
 				}
-			case "dest_ip":
+				s.Backend = args[0]
+			case "pppd_path":
+				if len(args) != 1 {
+					return argCountErr(d, directive, "1 argument", args)
+				}
+				s.PppdPath = args[0]
+			case "pppd_options":
 				if len(args) != 1 {
-					return c.ArgErr()
+					return argCountErr(d, directive, "1 argument", args)
+				}
+				s.PppdOptions = args[0]
+			case "path":
+				if len(args) != 1 {
+					return argCountErr(d, directive, "1 argument", args)
+				}
+				if !strings.HasPrefix(args[0], "/") {
+					return d.Errf("%s: request path %q must start with /", directive, args[0])
+				}
+				s.Path = args[0]
+			case "admin":
+				if len(args) < 1 {
+					return argCountErr(d, directive, "at least 1 argument", args)
 				}
-				server.destIP = net.ParseIP(args[0])
-				if server.destIP == nil { // parsing failed
-					return c.ArgErr()
+				if _, err := parseCIDRs(args[1:]); err != nil {
+					return d.Errf("%s: invalid network: %s", directive, err)
+				}
+				s.Admin = &AdminConfig{Path: args[0], Allow: args[1:]}
+			case "log_level":
+				if len(args) != 1 {
+					return argCountErr(d, directive, "1 argument", args)
+				}
+				if _, err := parseLogLevel(args[0]); err != nil {
+					return d.Errf("%s: %s", directive, err)
+				}
+				s.LogLevel = args[0]
+			case "server_header":
+				if len(args) != 1 {
+					return argCountErr(d, directive, "1 argument", args)
+				}
+				s.ServerHeader = args[0]
+			case "cert_hash":
+				// Pin the certificate hashes for crypto binding, e.g. when TLS is offloaded
+				if s.CertHash == nil {
+					s.CertHash = &CertHashConfig{}
+				}
+				switch len(args) {
+				case 1:
+					if args[0] == "off" {
+						s.CertHash.Off = true
+						break
+					}
+					if _, err := loadCertHashes(args[0]); err != nil {
+						return d.Errf("%s: failed to load certificate: %s", directive, err)
+					}
+					s.CertHash.File = args[0]
+				case 2:
+					switch strings.ToLower(args[0]) {
+					case "sha1":
+						s.CertHash.SHA1 = args[1]
+					case "sha256":
+						s.CertHash.SHA256 = args[1]
+					default:
+						return d.Errf("%s: unknown hash protocol %q, expected sha1 or sha256", directive, args[0])
+					}
+					if _, err := s.CertHash.hashes(); err != nil {
+						return d.Errf("%s: invalid certificate hash: %s", directive, err)
+					}
+				default:
+					return argCountErr(d, directive, "1 or 2 arguments", args)
+				}
+			case "compound_mac":
+				// Only "off" is accepted, as the Compound MAC is always checked otherwise
+				if len(args) != 1 || args[0] != "off" {
+					return d.Errf("%s: expected off, got %q", directive, strings.Join(args, " "))
+				}
+				s.SkipCompoundMAC = true
+			case "max_sessions", "max_sessions_per_ip":
+				n, err := parseCountArg(d, directive, args)
+				if err != nil {
+					return err
+				}
+				if s.Limits == nil {
+					s.Limits = &LimitsConfig{}
+				}
+				if directive == "max_sessions" {
+					s.Limits.MaxSessions = n
+				} else {
+					s.Limits.MaxSessionsPerIP = n
+				}
+			case "handshake_rate":
+				// handshake_rate <n> [interval], the number of handshakes allowed per client IP per interval
+				if len(args) != 1 && len(args) != 2 {
+					return argCountErr(d, directive, "1 or 2 arguments", args)
+				}
+				n, err := parseCountArg(d, directive, args[:1])
+				if err != nil {
+					return err
+				}
+				if s.Limits == nil {
+					s.Limits = &LimitsConfig{}
+				}
+				s.Limits.HandshakeRate = n
+				if len(args) == 2 {
+					interval, err := parseDurationArg(d, directive, args[1:])
+					if err != nil {
+						return err
+					}
+					s.Limits.HandshakeInterval = caddy.Duration(interval)
+				}
+			case "proxy":
+				if err := s.unmarshalProxy(d, args); err != nil {
+					return err
+				}
+			case "allow", "deny":
+				if len(args) < 1 {
+					return argCountErr(d, directive, "at least 1 argument", args)
+				}
+				if _, err := parseCIDRs(args); err != nil {
+					return d.Errf("%s: invalid network: %s", directive, err)
+				}
+				if s.Access == nil {
+					s.Access = &AccessConfig{}
+				}
+				if directive == "allow" {
+					s.Access.Allow = append(s.Access.Allow, args...)
+				} else {
+					s.Access.Deny = append(s.Access.Deny, args...)
+				}
+			case "denied":
+				// What denied clients get: the next handler, or 403 Forbidden
+				if len(args) != 1 {
+					return argCountErr(d, directive, "1 argument", args)
+				}
+				if s.Access == nil {
+					s.Access = &AccessConfig{}
+				}
+				switch args[0] {
+				case "next":
+					s.Access.Forbid = false
+				case "forbid":
+					s.Access.Forbid = true
+				default:
+					return d.Errf("%s: unknown action %q, expected next or forbid", directive, args[0])
 				}
 			default:
-				return c.ArgErr()
+				return d.Errf("unknown sstp subdirective %q", directive)
 			}
 		}
 	}
+	return nil
+}
 
-	cfg := httpserver.GetConfig(c)
-	mid := func(next httpserver.Handler) httpserver.Handler {
-		server.NextHandler = next
-		return server
+// unmarshalProxy parses the proxy subdirective and its block
+func (s *Server) unmarshalProxy(d *caddyfile.Dispenser, upstreams []string) error {
+	if s.Proxy == nil {
+		s.Proxy = &ProxyConfig{}
 	}
-	cfg.AddMiddleware(mid)
-	listenMid := func(next caddy.Listener) caddy.Listener {
-		listen := &Listener{Listener: next}
-		return listen
+	for _, addr := range upstreams {
+		if _, _, err := net.SplitHostPort(addr); err != nil {
+			return d.Errf("proxy: invalid upstream %q, expected host:port", addr)
+		}
 	}
-	cfg.AddListenerMiddleware(listenMid)
+	s.Proxy.Upstreams = append(s.Proxy.Upstreams, upstreams...)
 
+	for nesting := d.Nesting(); d.NextBlock(nesting); {
+		directive := d.Val()
+		args := d.RemainingArgs()
+		switch directive {
+		case "to":
+			if len(args) < 1 {
+				return argCountErr(d, directive, "at least 1 argument", args)
+			}
+			if err := s.unmarshalProxy(d, args); err != nil {
+				return err
+			}
+		case "lb_policy":
+			if len(args) != 1 {
+				return argCountErr(d, directive, "1 argument", args)
+			}
+			if !lbPolicies[args[0]] {
+				return d.Errf("%s: unknown policy %q, expected round_robin, random or least_conn", directive, args[0])
+			}
+			s.Proxy.LoadBalancing = args[0]
+		case "dial_timeout", "health_interval", "health_timeout":
+			dur, err := parseDurationArg(d, directive, args)
+			if err != nil {
+				return err
+			}
+			switch directive {
+			case "dial_timeout":
+				s.Proxy.DialTimeout = caddy.Duration(dur)
+			case "health_interval":
+				s.Proxy.HealthInterval = caddy.Duration(dur)
+			default:
+				s.Proxy.HealthTimeout = caddy.Duration(dur)
+			}
+		case "tls_server_name":
+			if len(args) != 1 {
+				return argCountErr(d, directive, "1 argument", args)
+			}
+			s.Proxy.TLSServerName = args[0]
+		case "tls_ca":
+			if len(args) != 1 {
+				return argCountErr(d, directive, "1 argument", args)
+			}
+			s.Proxy.TLSCA = args[0]
+		case "tls_insecure_skip_verify":
+			if len(args) != 0 {
+				return argCountErr(d, directive, "no arguments", args)
+			}
+			s.Proxy.TLSInsecureSkipVerify = true
+		default:
+			return d.Errf("unknown proxy subdirective %q", directive)
+		}
+	}
 	return nil
 }
+
+// UnmarshalCaddyfile sets up the listener wrapper from Caddyfile tokens. Syntax:
+//
+//	sstp {
+//		handshake_timeout <duration>
+//		log_level debug|info|warn|error
+//		proxy_protocol <trusted networks...>
+//	}
+func (lw *ListenerWrapper) UnmarshalCaddyfile(d *caddyfile.Dispenser) error {
+	for d.Next() { // skip the wrapper name
+		if d.NextArg() {
+			return d.ArgErr()
+		}
+		for d.NextBlock(0) {
+			directive := d.Val()
+			args := d.RemainingArgs()
+			switch directive {
+			case "handshake_timeout":
+				timeout, err := parseDurationArg(d, directive, args)
+				if err != nil {
+					return err
+				}
+				lw.HandshakeTimeout = caddy.Duration(timeout)
+			case "log_level":
+				if len(args) != 1 {
+					return argCountErr(d, directive, "1 argument", args)
+				}
+				if _, err := parseLogLevel(args[0]); err != nil {
+					return d.Errf("%s: %s", directive, err)
+				}
+				lw.LogLevel = args[0]
+			case "proxy_protocol":
+				if len(args) < 1 {
+					return argCountErr(d, directive, "at least 1 argument", args)
+				}
+				if _, err := parseCIDRs(args); err != nil {
+					return d.Errf("%s: invalid network: %s", directive, err)
+				}
+				lw.ProxyProtocol = &ProxyProtocolConfig{Trusted: args}
+			default:
+				return d.Errf("unknown sstp listener subdirective %q", directive)
+			}
+		}
+	}
+	return nil
+}
+
+// backends are the names of the PPP backends that can be configured
+var backends = map[string]ppp.ConnectionType{
+	"pppd":   ppp.ConnectionTypePppd,
+	"tuntap": ppp.ConnectionTypeTunTap,
+	"vnat":   ppp.ConnectionTypeVirtualNAT,
+}
+
+// argCountErr reports a subdirective with the wrong number of arguments, on the line it is on
+func argCountErr(d *caddyfile.Dispenser, directive, expected string, args []string) error {
+	return d.Errf("%s: expected %s, got %d", directive, expected, len(args))
+}
+
+// parseIPArg checks the single IP address argument of a subdirective
+func parseIPArg(d *caddyfile.Dispenser, directive string, args []string) error {
+	if len(args) != 1 {
+		return argCountErr(d, directive, "1 argument", args)
+	}
+	if net.ParseIP(args[0]) == nil {
+		return d.Errf("%s: invalid IP address %q", directive, args[0])
+	}
+	return nil
+}
+
+// parseDurationArg parses the single duration argument of a subdirective, which must be positive
+func parseDurationArg(d *caddyfile.Dispenser, directive string, args []string) (time.Duration, error) {
+	if len(args) != 1 {
+		return 0, argCountErr(d, directive, "1 argument", args)
+	}
+	dur, err := caddy.ParseDuration(args[0])
+	if err != nil {
+		return 0, d.Errf("%s: invalid duration %q: %s", directive, args[0], err)
+	}
+	if dur <= 0 {
+		return 0, d.Errf("%s: duration %q must be positive", directive, args[0])
+	}
+	return dur, nil
+}
+
+// parseCountArg parses the single count argument of a subdirective, which must be positive
+func parseCountArg(d *caddyfile.Dispenser, directive string, args []string) (int, error) {
+	if len(args) != 1 {
+		return 0, argCountErr(d, directive, "1 argument", args)
+	}
+	n, err := strconv.Atoi(args[0])
+	if err != nil || n <= 0 {
+		return 0, d.Errf("%s: %q must be a positive integer", directive, args[0])
+	}
+	return n, nil
+}
+
+// Interface guards
+var (
+	_ caddy.Provisioner           = (*Server)(nil)
+	_ caddy.Validator             = (*Server)(nil)
+	_ caddy.CleanerUpper          = (*Server)(nil)
+	_ caddyhttp.MiddlewareHandler = (*Server)(nil)
+	_ caddyfile.Unmarshaler       = (*Server)(nil)
+	_ caddy.Provisioner           = (*ListenerWrapper)(nil)
+	_ caddy.ListenerWrapper       = (*ListenerWrapper)(nil)
+	_ caddyfile.Unmarshaler       = (*ListenerWrapper)(nil)
+)
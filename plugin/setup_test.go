@@ -0,0 +1,63 @@
+package plugin
+
+import (
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/caddyconfig/caddyfile"
+)
+
+func TestUnmarshalCaddyfile(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  Server
+		// The error must mention the line of the offending subdirective
+		errLine int
+	}{
+		{"backend", "sstp {\n\tbackend tuntap\n}", Server{Backend: "tuntap"}, 0},
+		{"backend unknown", "sstp {\n\tbackend slip\n}", Server{}, 2},
+		{"backend no argument", "sstp {\n\tbackend\n}", Server{}, 2},
+		{"pppd_path", "sstp {\n\tpppd_path /usr/local/sbin/pppd\n}", Server{PppdPath: "/usr/local/sbin/pppd"}, 0},
+		{"pppd_path two arguments", "sstp {\n\tpppd_path /usr/sbin/pppd nodetach\n}", Server{}, 2},
+		{"pppd_options", "sstp {\n\tpppd_options /etc/ppp/options.sstp\n}", Server{PppdOptions: "/etc/ppp/options.sstp"}, 0},
+		{"pppd_options no argument", "sstp {\n\tbackend pppd\n\tpppd_options\n}", Server{}, 3},
+		{"timeouts", "sstp {\n\thello_interval 30s\n\tnegotiation_timeout 1m\n\tabort_timeout 500ms\n}", Server{
+			HelloInterval:      caddy.Duration(30 * time.Second),
+			NegotiationTimeout: caddy.Duration(time.Minute),
+			AbortTimeout:       caddy.Duration(500 * time.Millisecond),
+		}, 0},
+		{"hello_interval invalid", "sstp {\n\thello_interval soon\n}", Server{}, 2},
+		{"negotiation_timeout zero", "sstp {\n\thello_interval 30s\n\tnegotiation_timeout 0s\n}", Server{}, 3},
+		{"abort_timeout negative", "sstp {\n\tabort_timeout -1s\n}", Server{}, 2},
+		{"abort_timeout no argument", "sstp {\n\n\tabort_timeout\n}", Server{}, 3},
+		{"path", "sstp {\n\tpath /vpn/\n}", Server{Path: "/vpn/"}, 0},
+		{"path relative", "sstp {\n\tpath vpn\n}", Server{}, 2},
+		{"path two arguments", "sstp {\n\tpath /a /b\n}", Server{}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var s Server
+			err := s.UnmarshalCaddyfile(caddyfile.NewTestDispenser(tt.input))
+			if tt.errLine != 0 {
+				if err == nil {
+					t.Fatal("UnmarshalCaddyfile() succeeded, want an error")
+				}
+				if line := "Testfile:" + strconv.Itoa(tt.errLine); !strings.HasSuffix(err.Error(), line) {
+					t.Errorf("UnmarshalCaddyfile() error = %q, want line %d", err, tt.errLine)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(s, tt.want) {
+				t.Errorf("UnmarshalCaddyfile() = %+v, want %+v", s, tt.want)
+			}
+		})
+	}
+}
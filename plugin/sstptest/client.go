@@ -0,0 +1,234 @@
+package sstptest
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/comp500/caddy-sstp/sstp"
+)
+
+// CorrelationID is sent in the SSTPCORRELATIONID header of Client handshakes
+const CorrelationID = "{62DFA5C0-E2E0-FD50-D286-B00F18B0C6F5}"
+
+// Client scripts the client side of a SSTP connection, one message at a time.
+// Unlike sstp.Conn, it sends exactly what it is told, so invalid messages and framing can be tested.
+type Client struct {
+	Conn *tls.Conn
+	HLAK []byte
+	// How long reads wait for the server
+	Timeout time.Duration
+
+	reader *bufio.Reader
+	sstp   *sstp.Reader
+}
+
+// Response is the response to a HTTP request, which may be a SSTP handshake
+type Response struct {
+	StatusCode int
+	Header     textproto.MIMEHeader
+}
+
+// HandshakeRequest returns the HTTP request of a valid SSTP handshake
+func HandshakeRequest() string {
+	return fmt.Sprintf("%s %s HTTP/1.1\r\nHost: %s\r\nContent-Length: %s\r\nSSTPCORRELATIONID: %s\r\n\r\n",
+		sstp.Method, sstp.RequestPath, ServerName, sstp.HandshakeContentLength, CorrelationID)
+}
+
+// WriteRaw sends bytes to the server as they are
+func (c *Client) WriteRaw(b []byte) error {
+	_, err := c.Conn.Write(b)
+	return err
+}
+
+// ReadResponse reads the HTTP response to a request.
+// Bodies aren't read, so only the first response can be read on a connection.
+func (c *Client) ReadResponse() (*Response, error) {
+	if c.reader == nil {
+		c.reader = bufio.NewReader(c.Conn)
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	// The response can't be read with net/http, as the Content-Length of SSTP handshakes overflows an int64
+	textReader := textproto.NewReader(c.reader)
+	statusLine, err := textReader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	proto, status, _ := strings.Cut(statusLine, " ")
+	code, _, _ := strings.Cut(status, " ")
+	statusCode, err := strconv.Atoi(code)
+	if !strings.HasPrefix(proto, "HTTP/1.") || err != nil {
+		return nil, fmt.Errorf("Invalid status line %q", statusLine)
+	}
+	header, err := textReader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	return &Response{StatusCode: statusCode, Header: header}, nil
+}
+
+// Handshake sends a valid SSTP handshake, and checks that the server accepts it
+func (c *Client) Handshake() error {
+	err := c.WriteRaw([]byte(HandshakeRequest()))
+	if err != nil {
+		return err
+	}
+	resp, err := c.ReadResponse()
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != 200 {
+		return &sstp.HandshakeError{Status: strconv.Itoa(resp.StatusCode)}
+	}
+	if length := resp.Header.Get("Content-Length"); length != sstp.HandshakeContentLength {
+		return fmt.Errorf("Unexpected Content-Length %q", length)
+	}
+	return nil
+}
+
+// WriteMessage sends a control message
+func (c *Client) WriteMessage(message sstp.Message) error {
+	packet, err := message.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return c.WriteRaw(packet)
+}
+
+// WriteData sends a data packet carrying a PPP frame
+func (c *Client) WriteData(frame []byte) error {
+	packet, err := sstp.AppendDataPacket(nil, frame)
+	if err != nil {
+		return err
+	}
+	return c.WriteRaw(packet)
+}
+
+// ReadPacket reads the next packet from the server, including the SSTP header
+func (c *Client) ReadPacket() (sstp.Header, []byte, error) {
+	if c.sstp == nil {
+		if c.reader == nil {
+			c.reader = bufio.NewReader(c.Conn)
+		}
+		c.sstp = sstp.NewReader(c.reader)
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(c.Timeout))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	header, packet, err := c.sstp.ReadPacket()
+	if err != nil {
+		return header, nil, err
+	}
+	// Copy the packet, so it isn't reused by the reader
+	copied := append([]byte(nil), packet...)
+	c.sstp.Release(packet)
+	return header, copied, nil
+}
+
+// ReadMessage reads the next control message from the server.
+// It returns an error if a data packet is received instead.
+func (c *Client) ReadMessage() (sstp.Message, error) {
+	header, packet, err := c.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	if !header.C {
+		return nil, errors.New("Data packet received instead of a control message")
+	}
+	var controlPacket sstp.ControlPacket
+	err = controlPacket.UnmarshalBinary(packet)
+	if err != nil {
+		return nil, err
+	}
+	return controlPacket.Message()
+}
+
+// ReadData reads the next data packet from the server, returning the PPP frame it carries.
+// It returns an error if a control message is received instead.
+func (c *Client) ReadData() ([]byte, error) {
+	header, packet, err := c.ReadPacket()
+	if err != nil {
+		return nil, err
+	}
+	if header.C {
+		return nil, errors.New("Control message received instead of a data packet")
+	}
+	return packet[sstp.HeaderLength:], nil
+}
+
+// ExpectMessage reads the next control message, and checks that it is of the expected type
+func (c *Client) ExpectMessage(messageType sstp.MessageType) (sstp.Message, error) {
+	message, err := c.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	if message.MessageType() != messageType {
+		return message, fmt.Errorf("Expected %s, received %s", messageType, message.MessageType())
+	}
+	return message, nil
+}
+
+// Connect sends Call Connect Request, and returns the Call Connect Ack with the crypto binding request
+func (c *Client) Connect() (*sstp.CallConnectAck, error) {
+	err := c.WriteMessage(&sstp.CallConnectRequest{ProtocolID: sstp.EncapsulatedProtocolIDPPP})
+	if err != nil {
+		return nil, err
+	}
+	message, err := c.ExpectMessage(sstp.MessageTypeCallConnectAck)
+	if err != nil {
+		return nil, err
+	}
+	return message.(*sstp.CallConnectAck), nil
+}
+
+// CallConnected creates a signed Call Connected message for a Call Connect Ack,
+// using SHA256 and the server's certificate, as a compliant client does
+func (c *Client) CallConnected(ack *sstp.CallConnectAck) (*sstp.CallConnected, error) {
+	message := &sstp.CallConnected{CryptoBinding: sstp.CryptoBinding{
+		HashProtocol: sstp.HashProtocolSHA256,
+		Nonce:        ack.CryptoBindingReq.Nonce,
+	}}
+	certificates := c.Conn.ConnectionState().PeerCertificates
+	if len(certificates) == 0 {
+		return nil, errors.New("No server certificate")
+	}
+	certHash, err := sstp.CertHash(sstp.HashProtocolSHA256, certificates[0].Raw)
+	if err != nil {
+		return nil, err
+	}
+	message.CryptoBinding.CertHash = certHash
+	err = message.Sign(c.HLAK)
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+// Establish runs the complete handshake: the HTTP handshake, Call Connect Request and Call Connected
+func (c *Client) Establish() error {
+	err := c.Handshake()
+	if err != nil {
+		return err
+	}
+	ack, err := c.Connect()
+	if err != nil {
+		return err
+	}
+	connected, err := c.CallConnected(ack)
+	if err != nil {
+		return err
+	}
+	return c.WriteMessage(connected)
+}
+
+// Close closes the connection without sending Call Disconnect
+func (c *Client) Close() error {
+	return c.Conn.Close()
+}
@@ -0,0 +1,114 @@
+package sstptest
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/comp500/caddy-sstp/ppp"
+)
+
+// FakePPP is an in-memory ppp.Connection. Frames from the client are received on Frames,
+// and frames are sent to the client with Send.
+type FakePPP struct {
+	Config ppp.Config
+	Frames chan []byte
+
+	hlak       []byte
+	closeOnce  sync.Once
+	closed     chan struct{}
+	lock       sync.Mutex
+	writeErr   error // Set by FailWrites
+	writePanic bool  // Set by PanicOnWrite
+}
+
+// ErrFakeClosed is returned when a closed FakePPP is used
+var ErrFakeClosed = errors.New("FakePPP closed")
+
+func newFakePPP(config ppp.Config, hlak []byte) *FakePPP {
+	return &FakePPP{Config: config, Frames: make(chan []byte, 64), hlak: hlak, closed: make(chan struct{})}
+}
+
+// Write receives a frame from the client
+func (f *FakePPP) Write(b []byte) (int, error) {
+	f.lock.Lock()
+	err, writePanic := f.writeErr, f.writePanic
+	f.lock.Unlock()
+	if writePanic {
+		panic("FakePPP write panicked")
+	}
+	if err != nil {
+		return 0, err
+	}
+	frame := append([]byte(nil), b...)
+	select {
+	case f.Frames <- frame:
+		return len(b), nil
+	case <-f.closed:
+		return 0, ErrFakeClosed
+	}
+}
+
+// FailWrites makes frames from the client fail with err, or be received normally if err is nil
+func (f *FakePPP) FailWrites(err error) {
+	f.lock.Lock()
+	f.writeErr = err
+	f.lock.Unlock()
+}
+
+// PanicOnWrite makes frames from the client panic in the server's session goroutine
+func (f *FakePPP) PanicOnWrite() {
+	f.lock.Lock()
+	f.writePanic = true
+	f.lock.Unlock()
+}
+
+// Close closes the connection, as the server does when the session ends
+func (f *FakePPP) Close() error {
+	f.closeOnce.Do(func() { close(f.closed) })
+	return nil
+}
+
+// Closed is closed when the server closes the connection
+func (f *FakePPP) Closed() <-chan struct{} {
+	return f.closed
+}
+
+// HigherLayerAuthKey implements ppp.KeyExporter, so the server checks the crypto binding compound MAC
+func (f *FakePPP) HigherLayerAuthKey() []byte {
+	return f.hlak
+}
+
+// Send sends a frame to the client
+func (f *FakePPP) Send(frame []byte) error {
+	select {
+	case <-f.closed:
+		return ErrFakeClosed
+	default:
+	}
+	_, err := f.Config.DestWriter.Write(frame)
+	return err
+}
+
+// Receive waits for the next frame from the client
+func (f *FakePPP) Receive(timeout time.Duration) ([]byte, error) {
+	select {
+	case frame := <-f.Frames:
+		return frame, nil
+	case <-f.closed:
+		return nil, io.EOF
+	case <-time.After(timeout):
+		return nil, errors.New("Timed out waiting for a PPP frame")
+	}
+}
+
+// WaitClosed waits for the server to close the connection, returning false if it isn't closed in time
+func (f *FakePPP) WaitClosed(timeout time.Duration) bool {
+	select {
+	case <-f.closed:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
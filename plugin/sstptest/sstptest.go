@@ -0,0 +1,233 @@
+// Package sstptest runs a plugin.Server in memory, for end-to-end tests of the SSTP server.
+//
+// A Harness serves the Server with net/http/httptest, behind the real ListenerWrapper and TLS.
+// Sessions get a FakePPP instead of a real PPP backend, and a Client scripts the SSTP side of the connection.
+package sstptest
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/caddyserver/caddy/v2"
+	"github.com/caddyserver/caddy/v2/modules/caddyhttp"
+	"github.com/comp500/caddy-sstp/plugin"
+	"github.com/comp500/caddy-sstp/ppp"
+	"github.com/comp500/caddy-sstp/sstp"
+)
+
+// ServerName is the name the Harness certificate is issued for
+const ServerName = "sstp.test"
+
+// DefaultTimeout is how long Harness and Client methods wait for something to happen
+const DefaultTimeout = 5 * time.Second
+
+// NextStatus is the status sent by the handler after the Server, for requests it passes on
+const NextStatus = http.StatusTeapot
+
+// Harness serves a plugin.Server over TLS on a local port
+type Harness struct {
+	Server      *plugin.Server
+	HTTP        *httptest.Server
+	Certificate *x509.Certificate
+	// The HLAK exported by every FakePPP, used by the Server for crypto binding
+	HLAK []byte
+
+	ppp      chan *FakePPP
+	hideHLAK atomic.Bool // Set by WithoutKeyExport
+	lock     sync.Mutex
+	startErr error // Set by FailPPPStart
+	tb       testing.TB
+}
+
+// New starts a Harness serving server, which is provisioned by New.
+// If server is nil, a Server with the default configuration is used.
+// Crypto binding is checked against the certificate served on each connection, and PPPBackend is replaced with FakePPP.
+// The Harness is closed when the test finishes.
+func New(tb testing.TB, server *plugin.Server) *Harness {
+	tb.Helper()
+	if server == nil {
+		server = &plugin.Server{}
+	}
+	cert, err := NewCertificate()
+	if err != nil {
+		tb.Fatalf("Failed to create certificate: %s", err)
+	}
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		tb.Fatalf("Failed to parse certificate: %s", err)
+	}
+
+	h := &Harness{
+		Server:      server,
+		Certificate: leaf,
+		HLAK:        make([]byte, 32),
+		ppp:         make(chan *FakePPP, 16),
+		tb:          tb,
+	}
+	rand.Read(h.HLAK)
+
+	server.PPPBackend = func(config ppp.Config) (ppp.Connection, error) {
+		h.lock.Lock()
+		err := h.startErr
+		h.lock.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		f := newFakePPP(config, h.HLAK)
+		select {
+		case h.ppp <- f:
+		default:
+			return nil, errors.New("Too many FakePPP connections not taken with NextPPP")
+		}
+		if h.hideHLAK.Load() {
+			// Only the ppp.Connection methods are visible to the server
+			return struct{ ppp.Connection }{f}, nil
+		}
+		return f, nil
+	}
+	ctx, cancel := caddy.NewContext(caddy.Context{Context: context.Background()})
+	tb.Cleanup(cancel)
+	if err := server.Provision(ctx); err != nil {
+		tb.Fatalf("Failed to provision server: %s", err)
+	}
+	if err := server.Validate(); err != nil {
+		tb.Fatalf("Invalid server config: %s", err)
+	}
+
+	wrapper := &plugin.ListenerWrapper{}
+	if err := wrapper.Provision(caddy.Context{}); err != nil {
+		tb.Fatalf("Failed to provision listener wrapper: %s", err)
+	}
+	next := caddyhttp.HandlerFunc(func(w http.ResponseWriter, r *http.Request) error {
+		w.WriteHeader(NextStatus)
+		return nil
+	})
+	h.HTTP = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := server.ServeHTTP(w, r, next)
+		if err == nil {
+			return
+		}
+		status := http.StatusInternalServerError
+		var handlerErr caddyhttp.HandlerError
+		if errors.As(err, &handlerErr) {
+			status = handlerErr.StatusCode
+		}
+		http.Error(w, err.Error(), status)
+	}))
+	// The wrapper goes after TLS, as it does in Caddy
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"http/1.1"}}
+	h.HTTP.Listener = wrapper.WrapListener(tls.NewListener(h.HTTP.Listener, tlsConfig))
+	h.HTTP.Start()
+
+	tb.Cleanup(h.Close)
+	return h
+}
+
+// Close stops the server, and disconnects its sessions
+func (h *Harness) Close() {
+	h.Server.Cleanup()
+	h.HTTP.Close()
+}
+
+// Addr returns the address the server listens on
+func (h *Harness) Addr() string {
+	return h.HTTP.Listener.Addr().String()
+}
+
+// TLSConfig returns a client TLS config that trusts the Harness certificate
+func (h *Harness) TLSConfig() *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(h.Certificate)
+	return &tls.Config{RootCAs: pool, ServerName: ServerName, NextProtos: []string{"http/1.1"}}
+}
+
+// Dial connects with the sstp package client, completing the SSTP handshake and crypto binding
+func (h *Harness) Dial() (*sstp.Conn, error) {
+	conn, err := sstp.Dial("tcp", h.Addr(), &sstp.ClientConfig{TLSConfig: h.TLSConfig(), Host: ServerName})
+	if err != nil {
+		return nil, err
+	}
+	// FakePPP doesn't authenticate, so crypto binding can follow immediately
+	err = conn.Connected(h.HLAK)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// DialClient connects a Client, without sending anything
+func (h *Harness) DialClient() *Client {
+	h.tb.Helper()
+	conn, err := tls.Dial("tcp", h.Addr(), h.TLSConfig())
+	if err != nil {
+		h.tb.Fatalf("Failed to connect: %s", err)
+	}
+	c := &Client{Conn: conn, HLAK: h.HLAK, Timeout: DefaultTimeout}
+	h.tb.Cleanup(func() { conn.Close() })
+	return c
+}
+
+// WithoutKeyExport makes the FakePPP connections started after it not implement ppp.KeyExporter,
+// like the pppd and native backends
+func (h *Harness) WithoutKeyExport() {
+	h.hideHLAK.Store(true)
+}
+
+// FailPPPStart makes the PPP connections started after it fail with err, or start normally if err is nil
+func (h *Harness) FailPPPStart(err error) {
+	h.lock.Lock()
+	h.startErr = err
+	h.lock.Unlock()
+}
+
+// NextPPP returns the next FakePPP started by the server, failing the test if none is started in time
+func (h *Harness) NextPPP() *FakePPP {
+	h.tb.Helper()
+	select {
+	case f := <-h.ppp:
+		return f
+	case <-time.After(DefaultTimeout):
+		h.tb.Fatal("No PPP connection started")
+		return nil
+	}
+}
+
+// NewCertificate creates a self-signed certificate for ServerName
+func NewCertificate() (tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: ServerName},
+		DNSNames:              []string{ServerName},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+}
@@ -0,0 +1,97 @@
+package plugin
+
+import (
+	"fmt"
+
+	"github.com/comp500/caddy-sstp/sstp"
+)
+
+// serverState is the state of the server SSTP state machine, as specified by MS-SSTP
+type serverState int
+
+// Constants for serverState values
+const (
+	serverStateCallDisconnected serverState = iota
+	serverStateConnectRequestPending
+	serverStateCallConnectedPending
+	serverStateCallConnected
+	serverStateCallAbortInProgress
+	serverStateCallDisconnectInProgress
+)
+
+func (k serverState) String() string {
+	switch k {
+	case serverStateCallDisconnected:
+		return "CallDisconnected"
+	case serverStateConnectRequestPending:
+		return "ServerConnectRequestPending"
+	case serverStateCallConnectedPending:
+		return "ServerCallConnectedPending"
+	case serverStateCallConnected:
+		return "ServerCallConnected"
+	case serverStateCallAbortInProgress:
+		return "CallAbortInProgress"
+	case serverStateCallDisconnectInProgress:
+		return "CallDisconnectInProgress"
+	default:
+		return fmt.Sprintf("Unknown(%d)", k)
+	}
+}
+
+// acceptsControl returns true if the control message is allowed in this state.
+// If it isn't, the connection must be aborted.
+func (k serverState) acceptsControl(messageType sstp.MessageType) bool {
+	switch k {
+	case serverStateConnectRequestPending:
+		return messageType == sstp.MessageTypeCallConnectRequest
+	case serverStateCallConnectedPending:
+		switch messageType {
+		case sstp.MessageTypeCallConnected, sstp.MessageTypeCallAbort, sstp.MessageTypeCallDisconnect,
+			sstp.MessageTypeEchoRequest, sstp.MessageTypeEchoResponse:
+			return true
+		}
+	case serverStateCallConnected:
+		switch messageType {
+		case sstp.MessageTypeCallAbort, sstp.MessageTypeCallDisconnect,
+			sstp.MessageTypeEchoRequest, sstp.MessageTypeEchoResponse:
+			return true
+		}
+	case serverStateCallAbortInProgress:
+		// Everything other than Call Abort is silently discarded
+		return true
+	case serverStateCallDisconnectInProgress:
+		switch messageType {
+		case sstp.MessageTypeCallAbort, sstp.MessageTypeCallDisconnect, sstp.MessageTypeCallDisconnectAck:
+			return true
+		}
+	}
+	return false
+}
+
+// acceptsData returns true if data packets are allowed in this state.
+// If they aren't, the connection must be aborted.
+func (k serverState) acceptsData() bool {
+	switch k {
+	case serverStateCallConnectedPending, serverStateCallConnected:
+		return true
+	case serverStateCallAbortInProgress, serverStateCallDisconnectInProgress:
+		// Data packets are silently discarded while tearing down
+		return true
+	}
+	return false
+}
+
+// forwardsData returns true if data packets should be passed to the PPP connection in this state.
+func (k serverState) forwardsData() bool {
+	return k == serverStateCallConnectedPending || k == serverStateCallConnected
+}
+
+// finished returns true if the connection has been torn down, and the session should end.
+func (k serverState) finished() bool {
+	return k == serverStateCallDisconnected
+}
+
+// tearingDown returns true if the server is waiting for the client to acknowledge Call Abort or Call Disconnect.
+func (k serverState) tearingDown() bool {
+	return k == serverStateCallAbortInProgress || k == serverStateCallDisconnectInProgress
+}
@@ -0,0 +1,81 @@
+package plugin
+
+import (
+	"testing"
+
+	"github.com/comp500/caddy-sstp/sstp"
+)
+
+// allMessageTypes are the defined message types, and one that isn't defined
+var allMessageTypes = []sstp.MessageType{
+	sstp.MessageTypeCallConnectRequest,
+	sstp.MessageTypeCallConnectAck,
+	sstp.MessageTypeCallConnectNak,
+	sstp.MessageTypeCallConnected,
+	sstp.MessageTypeCallAbort,
+	sstp.MessageTypeCallDisconnect,
+	sstp.MessageTypeCallDisconnectAck,
+	sstp.MessageTypeEchoRequest,
+	sstp.MessageTypeEchoResponse,
+	sstp.MessageType(0x20),
+}
+
+func TestAcceptsControl(t *testing.T) {
+	tests := []struct {
+		state    serverState
+		accepted []sstp.MessageType
+	}{
+		{serverStateCallDisconnected, nil},
+		{serverStateConnectRequestPending, []sstp.MessageType{sstp.MessageTypeCallConnectRequest}},
+		{serverStateCallConnectedPending, []sstp.MessageType{
+			sstp.MessageTypeCallConnected, sstp.MessageTypeCallAbort, sstp.MessageTypeCallDisconnect,
+			sstp.MessageTypeEchoRequest, sstp.MessageTypeEchoResponse,
+		}},
+		{serverStateCallConnected, []sstp.MessageType{
+			sstp.MessageTypeCallAbort, sstp.MessageTypeCallDisconnect,
+			sstp.MessageTypeEchoRequest, sstp.MessageTypeEchoResponse,
+		}},
+		{serverStateCallAbortInProgress, allMessageTypes},
+		{serverStateCallDisconnectInProgress, []sstp.MessageType{
+			sstp.MessageTypeCallAbort, sstp.MessageTypeCallDisconnect, sstp.MessageTypeCallDisconnectAck,
+		}},
+	}
+	for _, tt := range tests {
+		accepted := make(map[sstp.MessageType]bool)
+		for _, messageType := range tt.accepted {
+			accepted[messageType] = true
+		}
+		for _, messageType := range allMessageTypes {
+			if got := tt.state.acceptsControl(messageType); got != accepted[messageType] {
+				t.Errorf("%s.acceptsControl(%s) = %t, want %t", tt.state, messageType, got, accepted[messageType])
+			}
+		}
+	}
+}
+
+func TestAcceptsData(t *testing.T) {
+	tests := []struct {
+		state       serverState
+		accepts     bool
+		forwards    bool
+		tearingDown bool
+	}{
+		{serverStateCallDisconnected, false, false, false},
+		{serverStateConnectRequestPending, false, false, false},
+		{serverStateCallConnectedPending, true, true, false},
+		{serverStateCallConnected, true, true, false},
+		{serverStateCallAbortInProgress, true, false, true},
+		{serverStateCallDisconnectInProgress, true, false, true},
+	}
+	for _, tt := range tests {
+		if got := tt.state.acceptsData(); got != tt.accepts {
+			t.Errorf("%s.acceptsData() = %t, want %t", tt.state, got, tt.accepts)
+		}
+		if got := tt.state.forwardsData(); got != tt.forwards {
+			t.Errorf("%s.forwardsData() = %t, want %t", tt.state, got, tt.forwards)
+		}
+		if got := tt.state.tearingDown(); got != tt.tearingDown {
+			t.Errorf("%s.tearingDown() = %t, want %t", tt.state, got, tt.tearingDown)
+		}
+	}
+}
@@ -3,87 +3,273 @@ package plugin
 import (
 	"encoding/binary"
 	"errors"
-	"log"
-	"net"
+	"fmt"
+	"time"
 
 	"github.com/comp500/caddy-sstp/ppp"
+	"github.com/comp500/caddy-sstp/sstp"
+	"go.uber.org/zap"
 )
 
-func decodeHeader(input []byte) (bool, int, error) {
-	if len(input) < 4 {
-		log.Print()
-		return true, 0, errors.New("Packet not long enough")
+// handleDataPacket passes the data from a data packet to the PPP connection
+func (s *session) handleDataPacket(data []byte) {
+	if s.pppConnection == nil {
+		s.log.Error("PPP connection not started, aborting connection")
+		s.abort()
+		return
 	}
+	_, err := s.pppConnection.Write(data)
+	if err != nil {
+		s.log.Error("Failed to write to PPP connection, aborting connection", zap.Error(err))
+		s.abort()
+	}
+}
+
+// isFramingError returns true if err means a packet from the client couldn't be framed,
+// rather than the connection failing
+func isFramingError(err error) bool {
+	var lengthErr *sstp.LengthError
+	return errors.Is(err, sstp.ErrVersion) || errors.Is(err, sstp.ErrReserved) || errors.As(err, &lengthErr)
+}
+
+// The number of Call Connect Request messages the server will Nak before aborting the connection
+const maxCallConnectRetries = 3
 
-	majVer := input[0] >> 4
-	minVer := input[0] & 0xf
-	isControl := input[1] == 1
-	length := int(binary.BigEndian.Uint16(input[2:4]))
+// supportedEncapsulatedProtocols are the protocols that can be carried by the server
+var supportedEncapsulatedProtocols = []sstp.EncapsulatedProtocolID{sstp.EncapsulatedProtocolIDPPP}
 
-	if majVer == 1 && minVer == 0 && length > 4 {
-		return isControl, (length - 4), nil
+// newNonce generates the nonce of each CryptoBindingReq, and is replaced in tests
+var newNonce = sstp.NewNonce
+
+// validateConnectRequest checks the protocol requested by a Call Connect Request.
+// If the request can't be accepted, it returns the StatusInfo attributes to send in a Call Connect Nak.
+func validateConnectRequest(message *sstp.CallConnectRequest) []sstp.StatusInfo {
+	for _, p := range supportedEncapsulatedProtocols {
+		if p == message.ProtocolID {
+			return nil
+		}
 	}
 
-	// isControl, lengthToRead, err
-	return true, 0, errors.New("Invalid packet")
+	// List the protocols we do support
+	value := make([]byte, 2*len(supportedEncapsulatedProtocols))
+	for i, p := range supportedEncapsulatedProtocols {
+		binary.BigEndian.PutUint16(value[2*i:], uint16(p))
+	}
+	return []sstp.StatusInfo{{
+		AttribID: sstp.AttributeIDEncapsulatedProtocolID,
+		Status:   sstp.AttributeStatusValueNotSupported,
+		Value:    value,
+	}}
 }
 
-func parseControl(input []byte) sstpControlHeader {
-	controlHeader := sstpControlHeader{}
-	controlHeader.MessageType = MessageType(binary.BigEndian.Uint16(input[:2]))
-	controlHeader.AttributesLength = binary.BigEndian.Uint16(input[2:4])
-
-	attributes := make([]sstpAttribute, int(controlHeader.AttributesLength))
-	consumedBytes := 4
-	for i := 0; i < len(attributes); i++ {
-		attribute := sstpAttribute{}
-		// ignore Reserved byte
-		attribute.AttributeID = AttributeID(input[consumedBytes+1])
-		attribute.Length = binary.BigEndian.Uint16(input[(consumedBytes + 2):(consumedBytes + 4)])
-		attribute.Data = input[(consumedBytes + 4):(consumedBytes + int(attribute.Length))]
-		consumedBytes += int(attribute.Length)
-
-		attributes[i] = attribute
-	}
-	controlHeader.Attributes = attributes
-	return controlHeader
+func (s *session) handleControlPacket(packet []byte) {
+	var controlPacket sstp.ControlPacket
+	err := controlPacket.UnmarshalBinary(packet)
+	if err != nil {
+		s.log.Warn("Invalid control packet, aborting connection", zap.Error(err))
+		s.handshakeFailed(handshakeInvalidMessage)
+		s.abort(sstp.StatusInfo{Status: sstp.AttributeStatusInvalidFrameReceived})
+		return
+	}
+	metrics.controlMessageReceived(controlPacket.MessageType)
+
+	if !s.state.acceptsControl(controlPacket.MessageType) {
+		s.log.Warn("Control message not allowed, aborting connection", zap.Stringer("type", controlPacket.MessageType), zap.Stringer("state", s.state))
+		s.handshakeFailed(handshakeInvalidMessage)
+		s.abort(sstp.StatusInfo{Status: sstp.AttributeStatusUnacceptedFrameReceived})
+		return
+	}
+
+	message, err := controlPacket.Message()
+	s.log.Debug("Control message received", zap.Stringer("type", controlPacket.MessageType), zap.String("message", fmt.Sprintf("%+v", message)))
+
+	// While tearing down, only the messages that finish tearing down are handled
+	if s.state == serverStateCallAbortInProgress {
+		if controlPacket.MessageType == sstp.MessageTypeCallAbort {
+			s.state = serverStateCallDisconnected
+		}
+		return
+	}
+	if s.state == serverStateCallDisconnectInProgress {
+		switch message := message.(type) {
+		case *sstp.CallDisconnect:
+			s.sendMessage(&sstp.CallDisconnectAck{})
+		case *sstp.CallDisconnectAck:
+			s.state = serverStateCallDisconnected
+		case *sstp.CallAbort:
+			s.log.Info("Client aborted connection", zap.Stringers("status", message.StatusInfos))
+			s.state = serverStateCallDisconnected
+		}
+		return
+	}
+
+	if err != nil {
+		var attributeErr *sstp.AttributeError
+		if !errors.As(err, &attributeErr) {
+			s.log.Warn("Invalid control packet", zap.Error(err))
+			s.handshakeFailed(handshakeInvalidMessage)
+			s.abort(sstp.StatusInfo{Status: sstp.AttributeStatusInvalidFrameReceived})
+			return
+		}
+		if controlPacket.MessageType == sstp.MessageTypeCallConnectRequest {
+			s.handshakeFailed(handshakeInvalidMessage)
+			s.nakConnectRequest([]sstp.StatusInfo{attributeErr.StatusInfo()})
+			return
+		}
+		s.log.Warn("Invalid control packet", zap.Error(err))
+		s.handshakeFailed(handshakeInvalidMessage)
+		s.abort(attributeErr.StatusInfo())
+		return
+	}
+
+	switch message := message.(type) {
+	case *sstp.CallConnectRequest:
+		statusInfos := validateConnectRequest(message)
+		if len(statusInfos) > 0 {
+			s.handshakeFailed(handshakeUnsupportedProtocol)
+			s.nakConnectRequest(statusInfos)
+			return
+		}
+
+		nonce, err := newNonce()
+		if err != nil {
+			s.log.Error("Failed to generate nonce, aborting connection", zap.Error(err))
+			s.handshakeFailed(handshakeServerFailure)
+			s.abort()
+			return
+		}
+		s.nonce = nonce
+		s.sendMessage(&sstp.CallConnectAck{CryptoBindingReq: sstp.CryptoBindingReq{
+			HashProtocols: hashProtocolsSupported,
+			Nonce:         nonce,
+		}})
+		pppConn, err := s.newPPP(s.pppConfig)
+		if err != nil {
+			s.log.Error("Failed to start PPP connection, aborting connection", zap.Error(err))
+			s.handshakeFailed(handshakePPPFailed)
+			s.abort()
+			return
+		}
+		s.log.Info("PPP connection started", zap.Stringer("backend", s.pppConfig.ConnectionType))
+		s.pppConnection = pppConn
+		s.state = serverStateCallConnectedPending
+	case *sstp.CallConnected:
+		err := s.handleCallConnected(message, packet)
+		if err != nil {
+			s.log.Warn("Crypto binding failed, aborting connection", zap.Error(err))
+			s.handshakeFailed(handshakeCryptoBinding)
+			s.abort(sstp.StatusInfo{AttribID: sstp.AttributeIDCryptoBinding, Status: sstp.AttributeStatusInvalidFrameReceived})
+			return
+		}
+		s.state = serverStateCallConnected
+		s.handshakeDone = true
+		s.negotiationTimer = nil
+		metrics.handshake(handshakeSuccess)
+	case *sstp.CallDisconnect:
+		s.log.Info("Client disconnected", zap.Stringers("status", message.StatusInfos))
+		s.sendMessage(&sstp.CallDisconnectAck{})
+		s.closePPP()
+		s.state = serverStateCallDisconnectInProgress
+		s.teardownTimer = time.After(s.abortTimeout)
+	case *sstp.EchoRequest:
+		s.sendMessage(&sstp.EchoResponse{})
+	case *sstp.EchoResponse:
+		// The hello timer is reset for every packet received
+		if !s.echoSent.IsZero() {
+			metrics.echoReceived(time.Since(s.echoSent))
+			s.echoSent = time.Time{}
+		}
+	case *sstp.CallAbort:
+		s.log.Info("Client aborted connection", zap.Stringers("status", message.StatusInfos))
+		s.handshakeFailed(handshakeAborted)
+		// The client waits for our Call Abort before closing the connection
+		s.sendMessage(&sstp.CallAbort{})
+		s.closePPP()
+		s.state = serverStateCallAbortInProgress
+		s.teardownTimer = time.After(s.abortTimeout)
+	}
 }
 
-func handleDataPacket(data []byte, conn net.Conn, pppConnection ppp.Connection) {
-	//log.Printf("read: %v\n", dataHeader)
-	if pppConnection != nil {
-		_, err := pppConnection.Write(data)
-		handleErr(err)
-		//log.Printf("%v bytes written to pppd", n)
-	} else {
-		log.Fatal("pppd instance not started")
+// handshakeFailed records why the handshake failed, if it hasn't completed
+func (s *session) handshakeFailed(reason string) {
+	if !s.handshakeDone {
+		s.handshakeFailure = reason
 	}
 }
 
-func handleControlPacket(controlHeader sstpControlHeader, conn net.Conn, pppConfig ppp.Config, pppConnection ppp.Connection) *ppp.Connection {
-	log.Printf("read: %v\n", controlHeader)
-
-	if controlHeader.MessageType == MessageTypeCallConnectRequest {
-		sendConnectionAckPacket(conn)
-		// TODO: implement Nak?
-		// -> if protocols specified by req not supported
-		// however there is only PPP currently, so not a problem
-		pppConn, err := ppp.NewConnection(pppConfig)
-		handleErr(err)
-		log.Print("pppd instance created")
-		return pppConn
-	} else if controlHeader.MessageType == MessageTypeCallDisconnect {
-		sendDisconnectAckPacket(conn)
-		err := pppConnection.Close()
-		handleErr(err)
-	} else if controlHeader.MessageType == MessageTypeEchoRequest {
-		// TODO: implement hello timer and echo request?
-		sendEchoResponsePacket(conn)
-	} else if controlHeader.MessageType == MessageTypeCallAbort {
-		// TODO: parse error
-		log.Fatal("error encountered, connection aborted")
-	}
-	// TODO: implement connected
+// nakConnectRequest rejects a Call Connect Request, or aborts if the client has retried too many times
+func (s *session) nakConnectRequest(statusInfos []sstp.StatusInfo) {
+	s.connectRetries++
+	if s.connectRetries > maxCallConnectRetries {
+		s.log.Warn("Call Connect retry count exceeded, aborting connection")
+		s.handshakeFailed(handshakeRetryCountExceeded)
+		s.abort(sstp.StatusInfo{AttribID: sstp.AttributeIDEncapsulatedProtocolID, Status: sstp.AttributeStatusRetryCountExceeded})
+		return
+	}
+	s.sendMessage(&sstp.CallConnectNak{StatusInfos: statusInfos})
+}
 
+// handleCallConnected verifies the crypto binding sent by the client in Call Connected
+func (s *session) handleCallConnected(message *sstp.CallConnected, packet []byte) error {
+	err := verifyCryptoBinding(message.CryptoBinding, s.nonce, s.certHashes)
+	if err != nil {
+		return err
+	}
+
+	if s.skipMAC {
+		s.log.Debug("Not checking crypto binding compound MAC, as compound_mac is off")
+		return nil
+	}
+	// Clients using MS-CHAPv2 or EAP sign with the HLAK from PPP authentication, so the Compound MAC
+	// can only be checked if the PPP backend exports it
+	exporter, ok := s.pppConnection.(ppp.KeyExporter)
+	if !ok {
+		return ErrCryptoBindingNoHLAK
+	}
+	err = verifyCompoundMAC(packet, message.CryptoBinding, exporter.HigherLayerAuthKey())
+	if err != nil {
+		return err
+	}
+	s.log.Info("Crypto binding verified", zap.Stringer("hash_protocol", message.CryptoBinding.HashProtocol))
 	return nil
 }
+
+// abort sends Call Abort to the client and closes the PPP connection.
+// The connection is closed when the client replies with Call Abort, or after the abort timeout.
+func (s *session) abort(statusInfos ...sstp.StatusInfo) {
+	s.sendMessage(&sstp.CallAbort{StatusInfos: statusInfos})
+	s.closePPP()
+	s.state = serverStateCallAbortInProgress
+	s.teardownTimer = time.After(s.abortTimeout)
+}
+
+// disconnect sends Call Disconnect to the client and closes the PPP connection.
+// The connection is closed when the client replies with Call Disconnect Ack, or after the abort timeout.
+func (s *session) disconnect(statusInfos ...sstp.StatusInfo) {
+	s.sendMessage(&sstp.CallDisconnect{StatusInfos: statusInfos})
+	s.closePPP()
+	s.state = serverStateCallDisconnectInProgress
+	s.teardownTimer = time.After(s.abortTimeout)
+}
+
+// stop ends the session, as the server is shutting down
+func (s *session) stop() {
+	if s.state.tearingDown() {
+		return
+	}
+	if s.state == serverStateCallConnected {
+		s.disconnect()
+	} else {
+		s.abort()
+	}
+}
+
+func (s *session) closePPP() {
+	if s.pppConnection != nil {
+		err := s.pppConnection.Close()
+		if err != nil {
+			s.log.Warn("Failed to close PPP connection", zap.Error(err))
+		}
+		s.pppConnection = nil
+	}
+}
@@ -3,6 +3,8 @@ package ppp
 import (
 	"errors"
 	"time"
+
+	"go.uber.org/zap"
 )
 
 // Generic Control Protocol interface with helper methods for automatons
@@ -25,6 +27,8 @@ type controlProtocolHelper struct {
 	restartTimer        *time.Timer // TODO read from the timer
 	restartTimerExpired bool
 	failureCount        int
+	failed              func() // Called when negotiation fails, optional
+	logger              *zap.Logger
 }
 
 // Implement io.Writer
@@ -280,6 +284,10 @@ func (p *controlProtocolHelper) timeoutTriggered() error {
 			p.state = cpStateClosed
 		case cpStateReqSent, cpStateAckReceived, cpStateAckSent:
 			// passive?
+			// The configure requests weren't acknowledged, so negotiation failed
+			if p.failed != nil {
+				p.failed()
+			}
 			fallthrough
 		case cpStateStopping:
 			err := p.tlf()
@@ -3,7 +3,8 @@ package ppp
 import (
 	"encoding/binary"
 	"fmt"
-	"log"
+
+	"go.uber.org/zap"
 )
 
 type lcpProtocol struct{}
@@ -146,9 +147,9 @@ func (p *lcpProtocol) writeData(data []byte, h *controlProtocolHelper) (int, err
 
 	switch controlCode {
 	case controlCodeConfigureRequest:
-		log.Printf("It's a Configure-Request")
+		h.logger.Debug("Configure-Request received", zap.Stringer("protocol", protocolTypeLCP))
 	default:
-		log.Printf("%s not implemented", controlCode)
+		h.logger.Debug("Control code not implemented", zap.Stringer("protocol", protocolTypeLCP), zap.Stringer("code", controlCode))
 	}
 	// Must silently discard any Discard-Request packets
 
@@ -0,0 +1,11 @@
+package ppp
+
+import "go.uber.org/zap"
+
+// logger returns the configured Logger, or a logger that discards everything
+func (c Config) logger() *zap.Logger {
+	if c.Logger == nil {
+		return zap.NewNop()
+	}
+	return c.Logger
+}
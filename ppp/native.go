@@ -4,7 +4,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
-	"log"
+
+	"go.uber.org/zap"
 )
 
 // This file manages pppd connections for the native (pure Go) connection type.
@@ -19,6 +20,12 @@ type nativeConnection struct {
 	lcpHandler     controlProtocolHelper
 }
 
+// HigherLayerAuthKey returns nil, as the native backend doesn't authenticate the client.
+// SSTP uses a HLAK of zeros for the crypto binding of unauthenticated PPP links.
+func (p *nativeConnection) HigherLayerAuthKey() []byte {
+	return nil
+}
+
 func (p *nativeConnection) Write(data []byte) (int, error) {
 	if p.hasBeenClosed {
 		return 0, errors.New("ppp write after close")
@@ -35,10 +42,24 @@ func (p *nativeConnection) Close() error {
 func (p *nativeConnection) start() error {
 	echoRequest := [...]byte{0xff, 0x03, 0xc0, 0x21, 0x09, 0x00, 0x00, 0x08, 0x58, 0xa5, 0xe7, 0xc2}
 	p.DestWriter.Write(echoRequest[:])
-	p.lcpHandler = controlProtocolHelper{controlProtocol: &lcpProtocol{}}
+	p.lcpHandler = controlProtocolHelper{
+		controlProtocol: &lcpProtocol{},
+		failed:          p.negotiationFailed(protocolTypeLCP),
+		logger:          p.logger(),
+	}
 	return nil
 }
 
+// negotiationFailed returns a function that notifies the Observer that negotiation of a protocol failed
+func (p *nativeConnection) negotiationFailed(protocol protocolType) func() {
+	return func() {
+		p.logger().Warn("Negotiation failed", zap.Stringer("phase", p.linkStatus), zap.Stringer("protocol", protocol))
+		if p.Observer != nil {
+			p.Observer.NegotiationFailed(protocol.String())
+		}
+	}
+}
+
 // linkStatus is the current status of the PPP connection
 type linkStatus int
 
@@ -51,6 +72,23 @@ const (
 	linkStatusTerminate
 )
 
+func (k linkStatus) String() string {
+	switch k {
+	case linkStatusDead:
+		return "Dead"
+	case linkStatusEstablish:
+		return "Establish"
+	case linkStatusAuthenticate:
+		return "Authenticate"
+	case linkStatusNetwork:
+		return "Network"
+	case linkStatusTerminate:
+		return "Terminate"
+	default:
+		return fmt.Sprintf("Unknown(%d)", k)
+	}
+}
+
 // protocolType is the protocol that this PPP packet uses
 type protocolType uint16
 
@@ -117,24 +155,24 @@ func (p *nativeConnection) parsePPP(data []byte) (int, error) {
 
 	if p.linkStatus == linkStatusEstablish {
 		if protocolNumber == protocolTypeLCP {
-			log.Print("LCP")
+			p.logger().Debug("Packet received", zap.Stringer("phase", p.linkStatus), zap.Stringer("protocol", protocolNumber))
 			return p.lcpHandler.Write(data)
 		}
-		log.Print("Discarding packet")
+		p.logger().Debug("Discarding packet", zap.Stringer("phase", p.linkStatus), zap.Stringer("protocol", protocolNumber))
 		// silently discard, only allow LCP
 	}
 
 	if p.linkStatus == linkStatusAuthenticate {
 		switch protocolNumber {
 		case protocolTypeLCP:
-			log.Print("LCP")
+			p.logger().Debug("Packet received", zap.Stringer("phase", p.linkStatus), zap.Stringer("protocol", protocolNumber))
 			return p.lcpHandler.Write(data)
 		case protocolTypePAP:
-			log.Print("PAP")
+			p.logger().Debug("Packet received", zap.Stringer("phase", p.linkStatus), zap.Stringer("protocol", protocolNumber))
 		case protocolTypeCHAP:
-			log.Print("CHAP")
+			p.logger().Debug("Packet received", zap.Stringer("phase", p.linkStatus), zap.Stringer("protocol", protocolNumber))
 		default:
-			log.Print("Discarding packet")
+			p.logger().Debug("Discarding packet", zap.Stringer("phase", p.linkStatus), zap.Stringer("protocol", protocolNumber))
 			// silently discard
 		}
 	}
@@ -142,30 +180,30 @@ func (p *nativeConnection) parsePPP(data []byte) (int, error) {
 	if p.linkStatus == linkStatusNetwork {
 		switch protocolNumber {
 		case protocolTypeIP:
-			log.Print("IP")
+			p.logger().Debug("Packet received", zap.Stringer("phase", p.linkStatus), zap.Stringer("protocol", protocolNumber))
 		// for protocols known, but not used in this phase
 		case protocolTypePAP, protocolTypeCHAP:
-			log.Print("Discarding packet")
+			p.logger().Debug("Discarding packet", zap.Stringer("phase", p.linkStatus), zap.Stringer("protocol", protocolNumber))
 			// silently discard
 		case protocolTypeLCP:
-			log.Print("LCP")
+			p.logger().Debug("Packet received", zap.Stringer("phase", p.linkStatus), zap.Stringer("protocol", protocolNumber))
 			return p.lcpHandler.Write(data)
 		case protocolTypeIPCP:
-			log.Print("IPCP")
+			p.logger().Debug("Packet received", zap.Stringer("phase", p.linkStatus), zap.Stringer("protocol", protocolNumber))
 		case protocolTypeCCP:
-			log.Print("CCP")
+			p.logger().Debug("Packet received", zap.Stringer("phase", p.linkStatus), zap.Stringer("protocol", protocolNumber))
 		default:
 			// TODO send LCP Protocol Reject
-			log.Print("Unknown protocol, rejecting")
+			p.logger().Debug("Unknown protocol, rejecting", zap.Stringer("phase", p.linkStatus), zap.Stringer("protocol", protocolNumber))
 		}
 	}
 
 	if p.linkStatus == linkStatusTerminate {
 		if protocolNumber == protocolTypeLCP {
-			log.Print("LCP")
+			p.logger().Debug("Packet received", zap.Stringer("phase", p.linkStatus), zap.Stringer("protocol", protocolNumber))
 			return p.lcpHandler.Write(data)
 		}
-		log.Print("Discarding packet")
+		p.logger().Debug("Discarding packet", zap.Stringer("phase", p.linkStatus), zap.Stringer("protocol", protocolNumber))
 		// silently discard, only allow LCP
 	}
 
@@ -5,6 +5,8 @@ import (
 	"fmt"
 	"io"
 	"net"
+
+	"go.uber.org/zap"
 )
 
 // Config defines the settings that the PPP connection should use
@@ -13,9 +15,27 @@ type Config struct {
 	SrcIP          net.IP
 	ExtraArguments []string
 	ConnectionType ConnectionType
+	PppdPath       string // The pppd binary, defaults to DefaultPppdPath
+	PppdOptions    string // The pppd options file, defaults to DefaultPppdOptions
 	DestWriter     io.Writer
+	Observer       Observer    // Optional
+	Logger         *zap.Logger // Optional, defaults to discarding every message
+}
+
+// Observer is notified of events in PPP connections, e.g. to record metrics
+type Observer interface {
+	// NegotiationFailed is called when negotiation of a protocol (e.g. LCP) fails
+	NegotiationFailed(protocol string)
+	// ProcessExited is called when a PPP process (e.g. pppd) exits
+	ProcessExited(exitCode int)
 }
 
+// Defaults for pppd connections
+const (
+	DefaultPppdPath    = "pppd"
+	DefaultPppdOptions = "/etc/ppp/options.sstpd"
+)
+
 // ConnectionType is the connection method used by a connection
 type ConnectionType int
 
@@ -39,15 +59,31 @@ func (k ConnectionType) String() string {
 	}
 }
 
-// Connection is a PPP connection instance
+// Connection is a PPP connection instance.
+// Frames from the client are written to it, and it writes frames for the client to Config.DestWriter.
 type Connection interface {
 	io.WriteCloser
+}
+
+// connection is a Connection implemented by this package, which is started by NewConnection
+type connection interface {
+	Connection
 	start() error
 }
 
+// KeyExporter is implemented by connections that can export the Higher-Layer Authentication Key (HLAK)
+// derived from PPP authentication, which SSTP uses for crypto binding.
+// HigherLayerAuthKey returns nil if the authentication protocol doesn't derive one (e.g. PAP or CHAP).
+//
+// The tuntap and vnat connections implement it, returning nil as they don't authenticate.
+// The pppd connection doesn't, as pppd doesn't export the MPPE keys.
+type KeyExporter interface {
+	HigherLayerAuthKey() []byte
+}
+
 // NewConnection starts a new PPP connection from the given config
 func NewConnection(config Config) (*Connection, error) {
-	var conn Connection
+	var conn connection
 
 	switch config.ConnectionType {
 	case ConnectionTypeTunTap:
@@ -65,5 +101,6 @@ func NewConnection(config Config) (*Connection, error) {
 		return nil, err
 	}
 
-	return &conn, nil
+	var started Connection = conn
+	return &started, nil
 }
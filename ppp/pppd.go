@@ -2,8 +2,9 @@ package ppp
 
 import (
 	"io"
-	"log"
 	"os/exec"
+
+	"go.uber.org/zap"
 )
 
 // pppdConnection represents a connection to pppd
@@ -13,19 +14,36 @@ type pppdConnection struct {
 	stdin       io.WriteCloser
 	unescaper   pppUnescaper
 	isStarted   bool
+	exited      chan struct{} // Closed when pppd has exited
+}
+
+// pppdNegotiationExitCodes are the pppd exit codes that indicate negotiation failed, and the protocols that failed.
+// pppd doesn't report which protocol failed if no network protocol came up.
+var pppdNegotiationExitCodes = map[int]string{
+	10: "ppp",  // EXIT_NEGOTIATION_FAILED
+	11: "auth", // EXIT_PEER_AUTH_FAILED
+	19: "auth", // EXIT_AUTH_TOPEER_FAILED
 }
 
 // start starts pppd
 func (p *pppdConnection) start() error {
-	p.unescaper = newUnescaper(p.DestWriter)
+	p.unescaper = newUnescaper(p.DestWriter, p.logger())
 
-	args := []string{"notty", "file", "/etc/ppp/options.sstpd"}
+	options := p.PppdOptions
+	if options == "" {
+		options = DefaultPppdOptions
+	}
+	path := p.PppdPath
+	if path == "" {
+		path = DefaultPppdPath
+	}
+	args := []string{"notty", "file", options}
 	if p.SrcIP != nil && p.DestIP != nil {
 		ipArg := p.SrcIP.String() + ":" + p.DestIP.String()
 		args = append(args, ipArg)
 	}
 	args = append(args, p.ExtraArguments...)
-	pppdCmd := exec.Command("pppd", args...)
+	pppdCmd := exec.Command(path, args...)
 	pppdIn, err := pppdCmd.StdinPipe()
 	if err != nil {
 		return err
@@ -41,22 +59,38 @@ func (p *pppdConnection) start() error {
 
 	p.isStarted = true
 
-	// TODO: remove this?
+	p.exited = make(chan struct{})
 	go func() {
-		defer log.Print("pppd disconnected")
 		pppdCmd.Wait()
+		exitCode := pppdCmd.ProcessState.ExitCode()
+		p.logger().Info("pppd exited", zap.Int("code", exitCode))
+		if p.Observer != nil {
+			p.Observer.ProcessExited(exitCode)
+			if protocol, ok := pppdNegotiationExitCodes[exitCode]; ok {
+				p.Observer.NegotiationFailed(protocol)
+			}
+		}
+		close(p.exited)
 	}()
 
 	return nil
 }
 
-// Close kills pppd if it is still running
+// Close kills pppd if it is still running, and waits for it to exit
 func (p *pppdConnection) Close() error {
 	if p.isStarted && p.commandInst != nil {
+		p.isStarted = false
+		p.stdin.Close()
+		select {
+		case <-p.exited:
+			return nil
+		default:
+		}
 		err := p.commandInst.Process.Kill()
 		if err != nil {
 			return err
 		}
+		<-p.exited
 	}
 	p.isStarted = false
 	return nil
@@ -173,12 +207,13 @@ func pppEscape(inputBytes []byte) []byte {
 type pppUnescaper struct {
 	currentPacket []byte
 	outputWriter  io.Writer
+	logger        *zap.Logger
 	currentPos    int
 	escaped       bool
 }
 
-func newUnescaper(outputWriter io.Writer) pppUnescaper {
-	return pppUnescaper{outputWriter: outputWriter, currentPacket: make([]byte, maxFrameSize)}
+func newUnescaper(outputWriter io.Writer, logger *zap.Logger) pppUnescaper {
+	return pppUnescaper{outputWriter: outputWriter, logger: logger, currentPacket: make([]byte, maxFrameSize)}
 }
 
 func (p pppUnescaper) Write(data []byte) (int, error) {
@@ -201,7 +236,7 @@ func (p pppUnescaper) Write(data []byte) (int, error) {
 			p.currentPacket[p.currentPos] = v
 			p.currentPos++
 		} else {
-			log.Print("Packet trimmed")
+			p.logger.Warn("Packet trimmed", zap.Int("size", maxFrameSize))
 		}
 		bytesWritten++
 	}
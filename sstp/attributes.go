@@ -0,0 +1,175 @@
+package sstp
+
+import (
+	"encoding"
+	"encoding/binary"
+	"fmt"
+)
+
+// AttributeMarshaler is implemented by the decoded values of each attribute type
+type AttributeMarshaler interface {
+	encoding.BinaryMarshaler
+	AttributeID() AttributeID
+}
+
+// AttributeValue is implemented by pointers to the decoded values of each attribute type
+type AttributeValue interface {
+	AttributeMarshaler
+	encoding.BinaryUnmarshaler
+}
+
+// NewAttribute encodes an attribute value into an attribute
+func NewAttribute(v AttributeMarshaler) (Attribute, error) {
+	value, err := v.MarshalBinary()
+	if err != nil {
+		return Attribute{}, err
+	}
+	return Attribute{v.AttributeID(), value}, nil
+}
+
+// Decode decodes the value of the attribute into v, which must be of the same attribute type
+func (a Attribute) Decode(v AttributeValue) error {
+	if a.ID != v.AttributeID() {
+		return fmt.Errorf("Expected %s attribute, got %s", v.AttributeID(), a.ID)
+	}
+	return v.UnmarshalBinary(a.Value)
+}
+
+// Lengths of the attribute values, excluding the attribute header
+const (
+	encapsulatedProtocolIDLength = 2
+	statusInfoMinLength          = 8
+	cryptoBindingReqLength       = 36
+	cryptoBindingLength          = 100
+)
+
+// AttributeID implements AttributeMarshaler
+func (k EncapsulatedProtocolID) AttributeID() AttributeID {
+	return AttributeIDEncapsulatedProtocolID
+}
+
+// MarshalBinary encodes the EncapsulatedProtocolID attribute value
+func (k EncapsulatedProtocolID) MarshalBinary() ([]byte, error) {
+	b := make([]byte, encapsulatedProtocolIDLength)
+	binary.BigEndian.PutUint16(b, uint16(k))
+	return b, nil
+}
+
+// UnmarshalBinary decodes the EncapsulatedProtocolID attribute value
+func (k *EncapsulatedProtocolID) UnmarshalBinary(b []byte) error {
+	if len(b) != encapsulatedProtocolIDLength {
+		return &LengthError{"EncapsulatedProtocolID attribute value", encapsulatedProtocolIDLength, len(b)}
+	}
+	*k = EncapsulatedProtocolID(binary.BigEndian.Uint16(b))
+	return nil
+}
+
+// StatusInfo describes the status of an attribute, or of the connection if AttribID is 0
+type StatusInfo struct {
+	AttribID AttributeID
+	Status   AttributeStatus
+	Value    []byte // Optional, e.g. the supported values when a value is not supported
+}
+
+func (k StatusInfo) String() string {
+	if k.AttribID == 0 {
+		return k.Status.String()
+	}
+	return fmt.Sprintf("%s (%s)", k.Status, k.AttribID)
+}
+
+// AttributeID implements AttributeMarshaler
+func (k StatusInfo) AttributeID() AttributeID {
+	return AttributeIDStatusInfo
+}
+
+// MarshalBinary encodes the StatusInfo attribute value
+func (k StatusInfo) MarshalBinary() ([]byte, error) {
+	// Reserved (3 bytes), AttribID, Status, AttribValue
+	b := make([]byte, statusInfoMinLength+len(k.Value))
+	b[3] = uint8(k.AttribID)
+	binary.BigEndian.PutUint32(b[4:8], uint32(k.Status))
+	copy(b[8:], k.Value)
+	return b, nil
+}
+
+// UnmarshalBinary decodes the StatusInfo attribute value.
+// The Value refers to the same memory as b.
+func (k *StatusInfo) UnmarshalBinary(b []byte) error {
+	if len(b) < statusInfoMinLength {
+		return &LengthError{"StatusInfo attribute value", statusInfoMinLength, len(b)}
+	}
+	// ignore 3 Reserved bytes
+	k.AttribID = AttributeID(b[3])
+	k.Status = AttributeStatus(binary.BigEndian.Uint32(b[4:8]))
+	k.Value = b[8:]
+	return nil
+}
+
+// CryptoBindingReq is sent by the server in Call Connect Ack, to request crypto binding
+type CryptoBindingReq struct {
+	HashProtocols HashProtocol // Bitmask of the supported hash protocols
+	Nonce         [32]byte
+}
+
+// AttributeID implements AttributeMarshaler
+func (k CryptoBindingReq) AttributeID() AttributeID {
+	return AttributeIDCryptoBindingReq
+}
+
+// MarshalBinary encodes the CryptoBindingReq attribute value
+func (k CryptoBindingReq) MarshalBinary() ([]byte, error) {
+	// Reserved (3 bytes), Hash Protocol Bitmask, Nonce
+	b := make([]byte, cryptoBindingReqLength)
+	b[3] = uint8(k.HashProtocols)
+	copy(b[4:36], k.Nonce[:])
+	return b, nil
+}
+
+// UnmarshalBinary decodes the CryptoBindingReq attribute value
+func (k *CryptoBindingReq) UnmarshalBinary(b []byte) error {
+	if len(b) != cryptoBindingReqLength {
+		return &LengthError{"CryptoBindingReq attribute value", cryptoBindingReqLength, len(b)}
+	}
+	// ignore 3 Reserved bytes
+	k.HashProtocols = HashProtocol(b[3])
+	copy(k.Nonce[:], b[4:36])
+	return nil
+}
+
+// CryptoBinding is sent by the client in Call Connected, binding the tunnel to the PPP authentication
+type CryptoBinding struct {
+	HashProtocol HashProtocol
+	Nonce        [32]byte
+	CertHash     [32]byte // SHA1 hashes are padded with zeroes
+	CompoundMAC  [32]byte // SHA1 MACs are padded with zeroes
+}
+
+// AttributeID implements AttributeMarshaler
+func (k CryptoBinding) AttributeID() AttributeID {
+	return AttributeIDCryptoBinding
+}
+
+// MarshalBinary encodes the CryptoBinding attribute value
+func (k CryptoBinding) MarshalBinary() ([]byte, error) {
+	// Reserved (3 bytes), Hash Protocol Bitmask, Nonce, Cert Hash, Compound MAC
+	b := make([]byte, cryptoBindingLength)
+	b[3] = uint8(k.HashProtocol)
+	copy(b[4:36], k.Nonce[:])
+	copy(b[36:68], k.CertHash[:])
+	copy(b[68:100], k.CompoundMAC[:])
+	return b, nil
+}
+
+// UnmarshalBinary decodes the CryptoBinding attribute value
+func (k *CryptoBinding) UnmarshalBinary(b []byte) error {
+	if len(b) != cryptoBindingLength {
+		return &LengthError{"CryptoBinding attribute value", cryptoBindingLength, len(b)}
+	}
+	// ignore 3 Reserved bytes
+	k.HashProtocol = HashProtocol(b[3])
+	copy(k.Nonce[:], b[4:36])
+	copy(k.CertHash[:], b[36:68])
+	copy(k.CompoundMAC[:], b[68:100])
+	return nil
+}
@@ -0,0 +1,414 @@
+package sstp
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
+)
+
+// Method is the HTTP method of the SSTP handshake
+const Method = "SSTP_DUPLEX_POST"
+
+// RequestPath is the path that the SSTP handshake uses
+const RequestPath = "/sra_{BA195980-CD49-458b-9E23-C84EE0ADCD75}/"
+
+// HandshakeContentLength is the Content-Length sent in both directions of the SSTP handshake
+const HandshakeContentLength = "18446744073709551615"
+
+// ClientConfig configures a SSTP client connection
+type ClientConfig struct {
+	// TLSConfig is used to establish the TLS connection. If nil, the connection is not encrypted,
+	// which is only useful for testing.
+	TLSConfig *tls.Config
+	// Host is sent in the Host header, defaulting to the dialed address
+	Host string
+	// CorrelationID is sent in the SSTPCORRELATIONID header, and is randomly generated if empty
+	CorrelationID string
+}
+
+// Errors returned by the client
+var (
+	ErrConnectNak = errors.New("Server rejected Call Connect Request")
+	ErrAborted    = errors.New("Connection aborted")
+	ErrConnected  = errors.New("Call Connected already sent")
+)
+
+// ConnectNakError is returned when the server rejects the Call Connect Request with a Call Connect Nak.
+// It matches ErrConnectNak with errors.Is.
+type ConnectNakError struct {
+	// The StatusInfo attributes of the Call Connect Nak, e.g. the supported values of a rejected attribute
+	StatusInfos []StatusInfo
+}
+
+func (e *ConnectNakError) Error() string {
+	return ErrConnectNak.Error()
+}
+
+func (e *ConnectNakError) Unwrap() error {
+	return ErrConnectNak
+}
+
+// HandshakeError is returned when the server doesn't accept the HTTP handshake
+type HandshakeError struct {
+	Status string
+}
+
+func (e *HandshakeError) Error() string {
+	return "SSTP handshake failed: " + e.Status
+}
+
+// Conn is a client SSTP connection, carrying the packets of the encapsulated protocol (PPP).
+//
+// Each Read returns a single PPP frame, and each Write sends a single PPP frame.
+// PPP runs over the connection before crypto binding, so Connected must be called once PPP authentication completes.
+type Conn struct {
+	conn   net.Conn
+	reader *Reader
+	// The StatusInfo attributes of the Call Connect Nak, Call Abort or Call Disconnect that ended the connection
+	StatusInfos []StatusInfo
+
+	bindingReq CryptoBindingReq // From Call Connect Ack
+	writeLock  sync.Mutex
+	connected  bool
+	closed     bool
+}
+
+// Dial connects to a SSTP server, and completes the SSTP handshake
+func Dial(network, address string, config *ClientConfig) (*Conn, error) {
+	return DialContext(context.Background(), network, address, config)
+}
+
+// DialContext connects to a SSTP server using the provided context, and completes the SSTP handshake
+func DialContext(ctx context.Context, network, address string, config *ClientConfig) (*Conn, error) {
+	if config == nil {
+		config = &ClientConfig{}
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	configCopy := *config
+	if configCopy.Host == "" {
+		configCopy.Host = address
+	}
+	if configCopy.TLSConfig != nil {
+		tlsConfig := configCopy.TLSConfig.Clone()
+		if tlsConfig.ServerName == "" {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				host = address
+			}
+			tlsConfig.ServerName = host
+		}
+		tlsConn := tls.Client(conn, tlsConfig)
+		err = tlsConn.HandshakeContext(ctx)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+
+	c, err := NewClientConn(conn, &configCopy)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewClientConn completes the SSTP handshake over an established connection,
+// returning once the server has accepted the Call Connect Request.
+// If the connection is a *tls.Conn, its peer certificate is used for crypto binding in Connected.
+func NewClientConn(conn net.Conn, config *ClientConfig) (*Conn, error) {
+	if config == nil {
+		config = &ClientConfig{}
+	}
+	c := &Conn{conn: conn}
+
+	correlationID := config.CorrelationID
+	if correlationID == "" {
+		var err error
+		correlationID, err = NewCorrelationID()
+		if err != nil {
+			return nil, err
+		}
+	}
+	host := config.Host
+	if host == "" {
+		host = conn.RemoteAddr().String()
+	}
+
+	reader, err := ClientHandshake(conn, host, correlationID)
+	if err != nil {
+		return nil, err
+	}
+	c.reader = reader
+
+	err = c.writeMessage(&CallConnectRequest{ProtocolID: EncapsulatedProtocolIDPPP})
+	if err != nil {
+		return nil, err
+	}
+	ack, err := c.readConnectAck()
+	if err != nil {
+		return nil, err
+	}
+	c.bindingReq = ack.CryptoBindingReq
+	return c, nil
+}
+
+// Connected sends Call Connected with the crypto binding, and must be called once PPP authentication completes.
+// The hlak is the Higher-Layer Authentication Key derived by PPP authentication (e.g. from MS-CHAPv2 or EAP).
+// If it is nil (e.g. PAP or CHAP was used), 32 zero bytes are used as specified.
+func (c *Conn) Connected(hlak []byte) error {
+	c.writeLock.Lock()
+	connected := c.connected
+	c.connected = true
+	c.writeLock.Unlock()
+	if connected {
+		return ErrConnected
+	}
+
+	message, err := c.cryptoBinding(c.bindingReq, hlak)
+	if err != nil {
+		c.writeMessage(&CallAbort{})
+		return err
+	}
+	return c.writeMessage(message)
+}
+
+// ClientHandshake sends the HTTP handshake of a SSTP connection, and reads the server's response.
+// It returns a Reader for the SSTP packets that follow, which may already have been buffered.
+func ClientHandshake(conn net.Conn, host, correlationID string) (*Reader, error) {
+	_, err := fmt.Fprintf(conn, "%s %s HTTP/1.1\r\nHost: %s\r\nContent-Length: %s\r\nSSTPCORRELATIONID: %s\r\n\r\n",
+		Method, RequestPath, host, HandshakeContentLength, correlationID)
+	if err != nil {
+		return nil, err
+	}
+
+	// The response can't be read with net/http, as the Content-Length overflows an int64
+	bufferedReader := bufio.NewReader(conn)
+	textReader := textproto.NewReader(bufferedReader)
+	statusLine, err := textReader.ReadLine()
+	if err != nil {
+		return nil, err
+	}
+	_, status, _ := strings.Cut(statusLine, " ")
+	if !strings.HasPrefix(statusLine, "HTTP/1.") || !strings.HasPrefix(status, "200") {
+		return nil, &HandshakeError{statusLine}
+	}
+	_, err = textReader.ReadMIMEHeader()
+	if err != nil {
+		return nil, err
+	}
+	return NewReader(bufferedReader), nil
+}
+
+// NewCorrelationID generates a random correlation ID for the SSTPCORRELATIONID header of a handshake
+func NewCorrelationID() (string, error) {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("{%X-%X-%X-%X-%X}", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+func (c *Conn) readConnectAck() (*CallConnectAck, error) {
+	for {
+		header, packet, err := c.reader.ReadPacket()
+		if err != nil {
+			return nil, err
+		}
+		if !header.C {
+			// PPP can't have started yet, so there shouldn't be any data
+			c.reader.Release(packet)
+			continue
+		}
+
+		var controlPacket ControlPacket
+		err = controlPacket.UnmarshalBinary(packet)
+		if err == nil {
+			var message Message
+			message, err = controlPacket.Message()
+			switch message := message.(type) {
+			case *CallConnectAck:
+				c.reader.Release(packet)
+				return message, nil
+			case *CallConnectNak:
+				c.StatusInfos = copyStatusInfos(message.StatusInfos)
+				err = &ConnectNakError{StatusInfos: c.StatusInfos}
+			case *CallAbort:
+				c.StatusInfos = copyStatusInfos(message.StatusInfos)
+				err = ErrAborted
+			case *EchoRequest:
+				err = c.writeMessage(&EchoResponse{})
+				if err == nil {
+					c.reader.Release(packet)
+					continue
+				}
+			default:
+				if err == nil {
+					err = fmt.Errorf("Unexpected %s message during handshake", controlPacket.MessageType)
+				}
+			}
+		}
+		c.reader.Release(packet)
+		return nil, err
+	}
+}
+
+// copyStatusInfos copies StatusInfo attributes, including their values, out of a packet before it is released
+func copyStatusInfos(infos []StatusInfo) []StatusInfo {
+	copied := make([]StatusInfo, len(infos))
+	for i, info := range infos {
+		copied[i] = info
+		copied[i].Value = append([]byte(nil), info.Value...)
+	}
+	return copied
+}
+
+// cryptoBinding creates the signed Call Connected message for a CryptoBindingReq
+func (c *Conn) cryptoBinding(req CryptoBindingReq, hlak []byte) (*CallConnected, error) {
+	var hashProtocol HashProtocol
+	if req.HashProtocols&HashProtocolSHA256 != 0 {
+		hashProtocol = HashProtocolSHA256
+	} else if req.HashProtocols&HashProtocolSHA1 != 0 {
+		hashProtocol = HashProtocolSHA1
+	} else {
+		return nil, ErrHashProtocol
+	}
+
+	message := &CallConnected{CryptoBinding{HashProtocol: hashProtocol, Nonce: req.Nonce}}
+	if tlsConn, ok := c.conn.(*tls.Conn); ok {
+		certificates := tlsConn.ConnectionState().PeerCertificates
+		if len(certificates) > 0 {
+			certHash, err := CertHash(hashProtocol, certificates[0].Raw)
+			if err != nil {
+				return nil, err
+			}
+			message.CryptoBinding.CertHash = certHash
+		}
+	}
+	err := message.Sign(hlak)
+	if err != nil {
+		return nil, err
+	}
+	return message, nil
+}
+
+func (c *Conn) writeMessage(message Message) error {
+	packet, err := message.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err = c.conn.Write(packet)
+	return err
+}
+
+// Read reads a single PPP frame into b, handling any control messages received before it.
+// If b is too small for the frame, the rest of the frame is discarded and io.ErrShortBuffer is returned.
+//
+// When the server disconnects, Read returns io.EOF. When the server aborts, Read returns ErrAborted.
+func (c *Conn) Read(b []byte) (int, error) {
+	for {
+		header, packet, err := c.reader.ReadPacket()
+		if err != nil {
+			return 0, err
+		}
+		if !header.C {
+			n := copy(b, packet[HeaderLength:])
+			short := n < len(packet)-HeaderLength
+			c.reader.Release(packet)
+			if short {
+				return n, io.ErrShortBuffer
+			}
+			return n, nil
+		}
+
+		err = c.handleControlPacket(packet)
+		c.reader.Release(packet)
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (c *Conn) handleControlPacket(packet []byte) error {
+	var controlPacket ControlPacket
+	err := controlPacket.UnmarshalBinary(packet)
+	if err != nil {
+		return err
+	}
+	message, err := controlPacket.Message()
+	if err != nil {
+		return err
+	}
+
+	switch message := message.(type) {
+	case *EchoRequest:
+		return c.writeMessage(&EchoResponse{})
+	case *EchoResponse:
+		return nil
+	case *CallDisconnect:
+		c.StatusInfos = copyStatusInfos(message.StatusInfos)
+		c.writeMessage(&CallDisconnectAck{})
+		return io.EOF
+	case *CallAbort:
+		c.StatusInfos = copyStatusInfos(message.StatusInfos)
+		return ErrAborted
+	default:
+		return fmt.Errorf("Unexpected %s message", controlPacket.MessageType)
+	}
+}
+
+// Write sends a single PPP frame
+func (c *Conn) Write(b []byte) (int, error) {
+	packet, err := AppendDataPacket(make([]byte, 0, HeaderLength+len(b)), b)
+	if err != nil {
+		return 0, err
+	}
+	c.writeLock.Lock()
+	defer c.writeLock.Unlock()
+	_, err = c.conn.Write(packet)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Close sends Call Disconnect to the server, and closes the underlying connection
+func (c *Conn) Close() error {
+	c.writeLock.Lock()
+	closed := c.closed
+	c.closed = true
+	c.writeLock.Unlock()
+	if closed {
+		return nil
+	}
+
+	c.writeMessage(&CallDisconnect{})
+	return c.conn.Close()
+}
+
+// LocalAddr returns the local address of the underlying connection
+func (c *Conn) LocalAddr() net.Addr {
+	return c.conn.LocalAddr()
+}
+
+// RemoteAddr returns the remote address of the underlying connection
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.conn.RemoteAddr()
+}
@@ -0,0 +1,75 @@
+package sstp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"net/textproto"
+	"reflect"
+	"testing"
+)
+
+// fakeServer accepts the handshake and Call Connect Request of a client on conn, and replies with message
+func fakeServer(t *testing.T, conn net.Conn, message Message) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	textReader := textproto.NewReader(reader)
+	_, err := textReader.ReadLine()
+	if err == nil {
+		_, err = textReader.ReadMIMEHeader()
+	}
+	if err == nil {
+		_, err = io.WriteString(conn, "HTTP/1.1 200 OK\r\nContent-Length: "+HandshakeContentLength+"\r\n\r\n")
+	}
+	if err == nil {
+		_, _, err = NewReader(reader).ReadPacket()
+	}
+	var packet []byte
+	if err == nil {
+		packet, err = message.MarshalBinary()
+	}
+	if err == nil {
+		_, err = conn.Write(packet)
+	}
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestClientConnectNak(t *testing.T) {
+	statusInfos := []StatusInfo{{AttributeIDEncapsulatedProtocolID, AttributeStatusValueNotSupported, []byte{0, 1}}}
+	client, server := net.Pipe()
+	go fakeServer(t, server, &CallConnectNak{StatusInfos: statusInfos})
+
+	_, err := NewClientConn(client, nil)
+	client.Close()
+	var nakErr *ConnectNakError
+	if !errors.As(err, &nakErr) {
+		t.Fatalf("Expected ConnectNakError, got %v", err)
+	}
+	if !errors.Is(err, ErrConnectNak) {
+		t.Error("ConnectNakError doesn't match ErrConnectNak")
+	}
+	if !reflect.DeepEqual(nakErr.StatusInfos, statusInfos) {
+		t.Errorf("Expected StatusInfos %v, got %v", statusInfos, nakErr.StatusInfos)
+	}
+}
+
+func TestCopyStatusInfos(t *testing.T) {
+	packet := []byte{0, 1, 0, 2}
+	infos := []StatusInfo{
+		{AttributeIDEncapsulatedProtocolID, AttributeStatusValueNotSupported, packet[0:2]},
+		{0, AttributeStatusNegotiationTimeout, packet[2:2]},
+	}
+	copied := copyStatusInfos(infos)
+	// The packet buffer is reused for the next packet once released
+	copy(packet, []byte{0xff, 0xff, 0xff, 0xff})
+	if !bytes.Equal(copied[0].Value, []byte{0, 1}) {
+		t.Errorf("Copied Value changed with the packet: %x", copied[0].Value)
+	}
+	if copied[1].Status != AttributeStatusNegotiationTimeout || len(copied[1].Value) != 0 {
+		t.Errorf("Unexpected copy %v", copied[1])
+	}
+}
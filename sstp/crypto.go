@@ -0,0 +1,91 @@
+package sstp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+)
+
+// Lengths of crypto binding fields
+const (
+	callConnectedLength = 112
+	compoundMACOffset   = 80 // Offset of the Compound MAC within the Call Connected packet
+	hlakLength          = 32
+)
+
+// cmkSeed is the seed used to derive the Compound MAC Key from the HLAK
+const cmkSeed = "SSTP inner method derived CMK"
+
+// ErrHashProtocol is returned when a crypto binding uses an unsupported hash protocol
+var ErrHashProtocol = errors.New("Unsupported crypto binding hash protocol")
+
+// NewNonce generates a random nonce for CryptoBindingReq
+func NewNonce() ([32]byte, error) {
+	var nonce [32]byte
+	_, err := rand.Read(nonce[:])
+	return nonce, err
+}
+
+// CertHash hashes a DER encoded certificate for the CertHash field of CryptoBinding
+func CertHash(hashProtocol HashProtocol, cert []byte) ([32]byte, error) {
+	var output [32]byte
+	newHash := hashProtocol.Hash()
+	if newHash == nil {
+		return output, ErrHashProtocol
+	}
+	h := newHash()
+	h.Write(cert)
+	copy(output[:], h.Sum(nil))
+	return output, nil
+}
+
+// ComputeCompoundMAC computes the Compound MAC of an encoded Call Connected packet, as specified by MS-SSTP.
+// The Compound MAC field already in the packet is treated as zeroes.
+//
+// If the HLAK is nil (e.g. PAP or CHAP was used), 32 zero bytes are used as specified.
+func ComputeCompoundMAC(hashProtocol HashProtocol, hlak []byte, packet []byte) ([32]byte, error) {
+	var output [32]byte
+	newHash := hashProtocol.Hash()
+	if newHash == nil {
+		return output, ErrHashProtocol
+	}
+	if len(packet) != callConnectedLength {
+		return output, &LengthError{"CallConnected packet", callConnectedLength, len(packet)}
+	}
+	if hlak == nil {
+		hlak = make([]byte, hlakLength)
+	}
+
+	// CMK = PRF(HLAK, seed, LEN), where only the first iteration is needed
+	cmkMac := hmac.New(newHash, hlak)
+	cmkMac.Write([]byte(cmkSeed))
+	var lengthAndIteration [3]byte
+	binary.LittleEndian.PutUint16(lengthAndIteration[:2], uint16(cmkMac.Size()))
+	lengthAndIteration[2] = 1
+	cmkMac.Write(lengthAndIteration[:])
+	cmk := cmkMac.Sum(nil)
+
+	// The MAC is calculated with the Compound MAC field zeroed
+	var zeroMAC [32]byte
+	mac := hmac.New(newHash, cmk)
+	mac.Write(packet[:compoundMACOffset])
+	mac.Write(zeroMAC[:])
+	copy(output[:], mac.Sum(nil))
+	return output, nil
+}
+
+// Sign sets the Compound MAC of the message, using the HLAK from PPP authentication
+func (m *CallConnected) Sign(hlak []byte) error {
+	m.CryptoBinding.CompoundMAC = [32]byte{}
+	packet, err := m.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	mac, err := ComputeCompoundMAC(m.CryptoBinding.HashProtocol, hlak, packet)
+	if err != nil {
+		return err
+	}
+	m.CryptoBinding.CompoundMAC = mac
+	return nil
+}
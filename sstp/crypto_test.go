@@ -0,0 +1,117 @@
+package sstp
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"errors"
+	"hash"
+	"testing"
+)
+
+// referenceCompoundMAC computes the Compound MAC as MS-SSTP defines it, independently of ComputeCompoundMAC:
+// CMK = HMAC(HLAK, "SSTP inner method derived CMK" | LEN | 0x01), with LEN the MAC length as 2 little-endian bytes,
+// then HMAC(CMK, Call Connected packet with a zeroed Compound MAC), padded to 32 bytes.
+func referenceCompoundMAC(newHash func() hash.Hash, size byte, hlak, packet []byte) []byte {
+	seed := append([]byte("SSTP inner method derived CMK"), size, 0x00, 0x01)
+	cmk := hmac.New(newHash, hlak)
+	cmk.Write(seed)
+
+	zeroed := append([]byte(nil), packet...)
+	for i := 80; i < 112; i++ {
+		zeroed[i] = 0
+	}
+	mac := hmac.New(newHash, cmk.Sum(nil))
+	mac.Write(zeroed)
+	return append(mac.Sum(nil), make([]byte, 32-mac.Size())...)
+}
+
+func TestComputeCompoundMAC(t *testing.T) {
+	hlak := make([]byte, 32)
+	for i := range hlak {
+		hlak[i] = byte(0xa0 + i)
+	}
+	tests := []struct {
+		hashProtocol HashProtocol
+		newHash      func() hash.Hash
+		size         byte
+		hlak         []byte
+		referenceKey []byte
+	}{
+		{HashProtocolSHA256, sha256.New, sha256.Size, hlak, hlak},
+		{HashProtocolSHA1, sha1.New, sha1.Size, hlak, hlak},
+		// A nil HLAK (PAP or CHAP) is replaced with 32 zero bytes
+		{HashProtocolSHA256, sha256.New, sha256.Size, nil, make([]byte, 32)},
+		{HashProtocolSHA1, sha1.New, sha1.Size, nil, make([]byte, 32)},
+	}
+	for _, tt := range tests {
+		message := &CallConnected{CryptoBinding{HashProtocol: tt.hashProtocol}}
+		for i := range message.CryptoBinding.Nonce {
+			message.CryptoBinding.Nonce[i] = byte(i)
+			message.CryptoBinding.CertHash[i] = byte(0x40 + i)
+			// The Compound MAC already in the packet must be ignored
+			message.CryptoBinding.CompoundMAC[i] = 0xff
+		}
+		packet, err := message.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := referenceCompoundMAC(tt.newHash, tt.size, tt.referenceKey, packet)
+		mac, err := ComputeCompoundMAC(tt.hashProtocol, tt.hlak, packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(mac[:], want) {
+			t.Errorf("ComputeCompoundMAC(%s, hlak=%x) = %x, want %x", tt.hashProtocol, tt.hlak, mac, want)
+		}
+
+		err = message.Sign(tt.hlak)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(message.CryptoBinding.CompoundMAC[:], want) {
+			t.Errorf("Sign(%s, hlak=%x) = %x, want %x", tt.hashProtocol, tt.hlak, message.CryptoBinding.CompoundMAC, want)
+		}
+	}
+}
+
+func TestComputeCompoundMACErrors(t *testing.T) {
+	packet, err := (&CallConnected{CryptoBinding{HashProtocol: HashProtocolSHA256}}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, hashProtocol := range []HashProtocol{0, HashProtocolSHA1 | HashProtocolSHA256, 4} {
+		_, err = ComputeCompoundMAC(hashProtocol, nil, packet)
+		if !errors.Is(err, ErrHashProtocol) {
+			t.Errorf("ComputeCompoundMAC(%s) error = %v, want %v", hashProtocol, err, ErrHashProtocol)
+		}
+	}
+	var lengthErr *LengthError
+	_, err = ComputeCompoundMAC(HashProtocolSHA256, nil, packet[:len(packet)-1])
+	if !errors.As(err, &lengthErr) {
+		t.Errorf("ComputeCompoundMAC() of a truncated packet error = %v, want a LengthError", err)
+	}
+}
+
+func TestCertHash(t *testing.T) {
+	cert := []byte("not really a certificate")
+	sum256 := sha256.Sum256(cert)
+	sum1 := sha1.Sum(cert)
+	var padded1 [32]byte
+	copy(padded1[:], sum1[:])
+
+	hash, err := CertHash(HashProtocolSHA256, cert)
+	if err != nil || hash != sum256 {
+		t.Errorf("CertHash(SHA256) = %x, %v, want %x", hash, err, sum256)
+	}
+	hash, err = CertHash(HashProtocolSHA1, cert)
+	if err != nil || hash != padded1 {
+		t.Errorf("CertHash(SHA1) = %x, %v, want %x", hash, err, padded1)
+	}
+	_, err = CertHash(HashProtocolSHA1|HashProtocolSHA256, cert)
+	if !errors.Is(err, ErrHashProtocol) {
+		t.Errorf("CertHash(SHA1|SHA256) error = %v, want %v", err, ErrHashProtocol)
+	}
+}
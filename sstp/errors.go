@@ -0,0 +1,56 @@
+package sstp
+
+import (
+	"errors"
+	"fmt"
+)
+
+// Errors returned when decoding SSTP headers
+var (
+	ErrVersion    = errors.New("Unsupported SSTP version")
+	ErrReserved   = errors.New("Reserved bits set in SSTP header")
+	ErrNotData    = errors.New("Expected SSTP data packet, got control packet")
+	ErrNotControl = errors.New("Expected SSTP control packet, got data packet")
+)
+
+// LengthError is returned when a packet or attribute is truncated, or its length fields are inconsistent
+type LengthError struct {
+	Field     string // The packet or attribute with the invalid length
+	Length    int    // The length required, or given by the length field
+	Available int    // The number of bytes actually available
+}
+
+func (e *LengthError) Error() string {
+	return fmt.Sprintf("Invalid %s length: %d, %d bytes available", e.Field, e.Length, e.Available)
+}
+
+// MessageTypeError is returned when unmarshaling a control packet into the wrong message type,
+// or when the message type is unknown (in which case Expected is 0)
+type MessageTypeError struct {
+	Expected MessageType
+	Actual   MessageType
+}
+
+func (e *MessageTypeError) Error() string {
+	if e.Expected == 0 {
+		return fmt.Sprintf("Unknown message type %s", e.Actual)
+	}
+	return fmt.Sprintf("Expected %s message, got %s", e.Expected, e.Actual)
+}
+
+// AttributeError is returned when a control message has missing, duplicate or unexpected attributes,
+// or when an attribute value is invalid. The status can be sent back to the peer in a StatusInfo attribute.
+type AttributeError struct {
+	MessageType MessageType
+	AttributeID AttributeID
+	Status      AttributeStatus
+}
+
+func (e *AttributeError) Error() string {
+	return fmt.Sprintf("%s attribute in %s: %s", e.AttributeID, e.MessageType, e.Status)
+}
+
+// StatusInfo returns the StatusInfo attribute describing this error
+func (e *AttributeError) StatusInfo() StatusInfo {
+	return StatusInfo{AttribID: e.AttributeID, Status: e.Status}
+}
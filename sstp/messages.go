@@ -0,0 +1,394 @@
+package sstp
+
+import (
+	"encoding"
+)
+
+// Message is implemented by the decoded control messages of each message type.
+//
+// MarshalBinary and UnmarshalBinary encode and decode the full control packet, including the SSTP header.
+type Message interface {
+	encoding.BinaryMarshaler
+	encoding.BinaryUnmarshaler
+	MessageType() MessageType
+	// ControlPacket encodes the message into a control packet
+	ControlPacket() (ControlPacket, error)
+	// DecodeControlPacket decodes a control packet of this message type into the message
+	DecodeControlPacket(p ControlPacket) error
+}
+
+// Message decodes the control packet into the message type it contains
+func (p ControlPacket) Message() (Message, error) {
+	var m Message
+	switch p.MessageType {
+	case MessageTypeCallConnectRequest:
+		m = &CallConnectRequest{}
+	case MessageTypeCallConnectAck:
+		m = &CallConnectAck{}
+	case MessageTypeCallConnectNak:
+		m = &CallConnectNak{}
+	case MessageTypeCallConnected:
+		m = &CallConnected{}
+	case MessageTypeCallAbort:
+		m = &CallAbort{}
+	case MessageTypeCallDisconnect:
+		m = &CallDisconnect{}
+	case MessageTypeCallDisconnectAck:
+		m = &CallDisconnectAck{}
+	case MessageTypeEchoRequest:
+		m = &EchoRequest{}
+	case MessageTypeEchoResponse:
+		m = &EchoResponse{}
+	default:
+		return nil, &MessageTypeError{0, p.MessageType}
+	}
+	err := m.DecodeControlPacket(p)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func marshalMessage(m Message) ([]byte, error) {
+	p, err := m.ControlPacket()
+	if err != nil {
+		return nil, err
+	}
+	return p.MarshalBinary()
+}
+
+func unmarshalMessage(m Message, b []byte) error {
+	var p ControlPacket
+	err := p.UnmarshalBinary(b)
+	if err != nil {
+		return err
+	}
+	return m.DecodeControlPacket(p)
+}
+
+func checkMessageType(p ControlPacket, expected MessageType) error {
+	if p.MessageType != expected {
+		return &MessageTypeError{expected, p.MessageType}
+	}
+	return nil
+}
+
+// unexpectedAttribute returns the error for an attribute that isn't allowed in a message
+func unexpectedAttribute(p ControlPacket, a Attribute) error {
+	if a.ID < AttributeIDEncapsulatedProtocolID || a.ID > AttributeIDCryptoBindingReq {
+		return &AttributeError{p.MessageType, a.ID, AttributeStatusUnrecognizedAttribute}
+	}
+	return &AttributeError{p.MessageType, a.ID, AttributeStatusAttribNotSupportedInMsg}
+}
+
+// decodeSingleAttribute decodes the only attribute of a message into v
+func decodeSingleAttribute(p ControlPacket, v AttributeValue) error {
+	found := false
+	for _, a := range p.Attributes {
+		if a.ID != v.AttributeID() {
+			return unexpectedAttribute(p, a)
+		}
+		if found {
+			return &AttributeError{p.MessageType, a.ID, AttributeStatusDuplicateAttribute}
+		}
+		found = true
+		if a.Decode(v) != nil {
+			return &AttributeError{p.MessageType, a.ID, AttributeStatusInvalidAttribValueLength}
+		}
+	}
+	if !found {
+		return &AttributeError{p.MessageType, v.AttributeID(), AttributeStatusRequiredAttributeMissing}
+	}
+	return nil
+}
+
+// decodeStatusInfos decodes the attributes of a message that may only contain StatusInfo attributes
+func decodeStatusInfos(p ControlPacket) ([]StatusInfo, error) {
+	statusInfos := make([]StatusInfo, len(p.Attributes))
+	for i, a := range p.Attributes {
+		if a.ID != AttributeIDStatusInfo {
+			return nil, unexpectedAttribute(p, a)
+		}
+		if a.Decode(&statusInfos[i]) != nil {
+			return nil, &AttributeError{p.MessageType, a.ID, AttributeStatusInvalidAttribValueLength}
+		}
+	}
+	return statusInfos, nil
+}
+
+// decodeNoAttributes checks that a message has no attributes
+func decodeNoAttributes(p ControlPacket) error {
+	if len(p.Attributes) > 0 {
+		return unexpectedAttribute(p, p.Attributes[0])
+	}
+	return nil
+}
+
+func encodeAttributes(messageType MessageType, values ...AttributeMarshaler) (ControlPacket, error) {
+	p := ControlPacket{messageType, make([]Attribute, len(values))}
+	for i, v := range values {
+		a, err := NewAttribute(v)
+		if err != nil {
+			return ControlPacket{}, err
+		}
+		p.Attributes[i] = a
+	}
+	return p, nil
+}
+
+func encodeStatusInfos(messageType MessageType, statusInfos []StatusInfo) (ControlPacket, error) {
+	values := make([]AttributeMarshaler, len(statusInfos))
+	for i := range statusInfos {
+		values[i] = statusInfos[i]
+	}
+	return encodeAttributes(messageType, values...)
+}
+
+// CallConnectRequest is sent by the client to start a connection
+type CallConnectRequest struct {
+	ProtocolID EncapsulatedProtocolID
+}
+
+// MessageType implements Message
+func (m *CallConnectRequest) MessageType() MessageType { return MessageTypeCallConnectRequest }
+
+// ControlPacket implements Message
+func (m *CallConnectRequest) ControlPacket() (ControlPacket, error) {
+	return encodeAttributes(m.MessageType(), m.ProtocolID)
+}
+
+// DecodeControlPacket implements Message
+func (m *CallConnectRequest) DecodeControlPacket(p ControlPacket) error {
+	err := checkMessageType(p, m.MessageType())
+	if err != nil {
+		return err
+	}
+	return decodeSingleAttribute(p, &m.ProtocolID)
+}
+
+// MarshalBinary implements Message
+func (m *CallConnectRequest) MarshalBinary() ([]byte, error) { return marshalMessage(m) }
+
+// UnmarshalBinary implements Message
+func (m *CallConnectRequest) UnmarshalBinary(b []byte) error { return unmarshalMessage(m, b) }
+
+// CallConnectAck is sent by the server to accept a connection
+type CallConnectAck struct {
+	CryptoBindingReq CryptoBindingReq
+}
+
+// MessageType implements Message
+func (m *CallConnectAck) MessageType() MessageType { return MessageTypeCallConnectAck }
+
+// ControlPacket implements Message
+func (m *CallConnectAck) ControlPacket() (ControlPacket, error) {
+	return encodeAttributes(m.MessageType(), m.CryptoBindingReq)
+}
+
+// DecodeControlPacket implements Message
+func (m *CallConnectAck) DecodeControlPacket(p ControlPacket) error {
+	err := checkMessageType(p, m.MessageType())
+	if err != nil {
+		return err
+	}
+	return decodeSingleAttribute(p, &m.CryptoBindingReq)
+}
+
+// MarshalBinary implements Message
+func (m *CallConnectAck) MarshalBinary() ([]byte, error) { return marshalMessage(m) }
+
+// UnmarshalBinary implements Message
+func (m *CallConnectAck) UnmarshalBinary(b []byte) error { return unmarshalMessage(m, b) }
+
+// CallConnectNak is sent by the server to reject a Call Connect Request, so the client can retry
+type CallConnectNak struct {
+	StatusInfos []StatusInfo
+}
+
+// MessageType implements Message
+func (m *CallConnectNak) MessageType() MessageType { return MessageTypeCallConnectNak }
+
+// ControlPacket implements Message
+func (m *CallConnectNak) ControlPacket() (ControlPacket, error) {
+	return encodeStatusInfos(m.MessageType(), m.StatusInfos)
+}
+
+// DecodeControlPacket implements Message
+func (m *CallConnectNak) DecodeControlPacket(p ControlPacket) error {
+	err := checkMessageType(p, m.MessageType())
+	if err != nil {
+		return err
+	}
+	m.StatusInfos, err = decodeStatusInfos(p)
+	return err
+}
+
+// MarshalBinary implements Message
+func (m *CallConnectNak) MarshalBinary() ([]byte, error) { return marshalMessage(m) }
+
+// UnmarshalBinary implements Message
+func (m *CallConnectNak) UnmarshalBinary(b []byte) error { return unmarshalMessage(m, b) }
+
+// CallConnected is sent by the client once PPP authentication has completed, with the crypto binding
+type CallConnected struct {
+	CryptoBinding CryptoBinding
+}
+
+// MessageType implements Message
+func (m *CallConnected) MessageType() MessageType { return MessageTypeCallConnected }
+
+// ControlPacket implements Message
+func (m *CallConnected) ControlPacket() (ControlPacket, error) {
+	return encodeAttributes(m.MessageType(), m.CryptoBinding)
+}
+
+// DecodeControlPacket implements Message
+func (m *CallConnected) DecodeControlPacket(p ControlPacket) error {
+	err := checkMessageType(p, m.MessageType())
+	if err != nil {
+		return err
+	}
+	return decodeSingleAttribute(p, &m.CryptoBinding)
+}
+
+// MarshalBinary implements Message
+func (m *CallConnected) MarshalBinary() ([]byte, error) { return marshalMessage(m) }
+
+// UnmarshalBinary implements Message
+func (m *CallConnected) UnmarshalBinary(b []byte) error { return unmarshalMessage(m, b) }
+
+// CallAbort is sent by either side to abort the connection after an error
+type CallAbort struct {
+	StatusInfos []StatusInfo
+}
+
+// MessageType implements Message
+func (m *CallAbort) MessageType() MessageType { return MessageTypeCallAbort }
+
+// ControlPacket implements Message
+func (m *CallAbort) ControlPacket() (ControlPacket, error) {
+	return encodeStatusInfos(m.MessageType(), m.StatusInfos)
+}
+
+// DecodeControlPacket implements Message
+func (m *CallAbort) DecodeControlPacket(p ControlPacket) error {
+	err := checkMessageType(p, m.MessageType())
+	if err != nil {
+		return err
+	}
+	m.StatusInfos, err = decodeStatusInfos(p)
+	return err
+}
+
+// MarshalBinary implements Message
+func (m *CallAbort) MarshalBinary() ([]byte, error) { return marshalMessage(m) }
+
+// UnmarshalBinary implements Message
+func (m *CallAbort) UnmarshalBinary(b []byte) error { return unmarshalMessage(m, b) }
+
+// CallDisconnect is sent by either side to disconnect gracefully
+type CallDisconnect struct {
+	StatusInfos []StatusInfo
+}
+
+// MessageType implements Message
+func (m *CallDisconnect) MessageType() MessageType { return MessageTypeCallDisconnect }
+
+// ControlPacket implements Message
+func (m *CallDisconnect) ControlPacket() (ControlPacket, error) {
+	return encodeStatusInfos(m.MessageType(), m.StatusInfos)
+}
+
+// DecodeControlPacket implements Message
+func (m *CallDisconnect) DecodeControlPacket(p ControlPacket) error {
+	err := checkMessageType(p, m.MessageType())
+	if err != nil {
+		return err
+	}
+	m.StatusInfos, err = decodeStatusInfos(p)
+	return err
+}
+
+// MarshalBinary implements Message
+func (m *CallDisconnect) MarshalBinary() ([]byte, error) { return marshalMessage(m) }
+
+// UnmarshalBinary implements Message
+func (m *CallDisconnect) UnmarshalBinary(b []byte) error { return unmarshalMessage(m, b) }
+
+// CallDisconnectAck acknowledges a Call Disconnect
+type CallDisconnectAck struct{}
+
+// MessageType implements Message
+func (m *CallDisconnectAck) MessageType() MessageType { return MessageTypeCallDisconnectAck }
+
+// ControlPacket implements Message
+func (m *CallDisconnectAck) ControlPacket() (ControlPacket, error) {
+	return encodeAttributes(m.MessageType())
+}
+
+// DecodeControlPacket implements Message
+func (m *CallDisconnectAck) DecodeControlPacket(p ControlPacket) error {
+	err := checkMessageType(p, m.MessageType())
+	if err != nil {
+		return err
+	}
+	return decodeNoAttributes(p)
+}
+
+// MarshalBinary implements Message
+func (m *CallDisconnectAck) MarshalBinary() ([]byte, error) { return marshalMessage(m) }
+
+// UnmarshalBinary implements Message
+func (m *CallDisconnectAck) UnmarshalBinary(b []byte) error { return unmarshalMessage(m, b) }
+
+// EchoRequest is sent by either side to check that the other side is still alive
+type EchoRequest struct{}
+
+// MessageType implements Message
+func (m *EchoRequest) MessageType() MessageType { return MessageTypeEchoRequest }
+
+// ControlPacket implements Message
+func (m *EchoRequest) ControlPacket() (ControlPacket, error) {
+	return encodeAttributes(m.MessageType())
+}
+
+// DecodeControlPacket implements Message
+func (m *EchoRequest) DecodeControlPacket(p ControlPacket) error {
+	err := checkMessageType(p, m.MessageType())
+	if err != nil {
+		return err
+	}
+	return decodeNoAttributes(p)
+}
+
+// MarshalBinary implements Message
+func (m *EchoRequest) MarshalBinary() ([]byte, error) { return marshalMessage(m) }
+
+// UnmarshalBinary implements Message
+func (m *EchoRequest) UnmarshalBinary(b []byte) error { return unmarshalMessage(m, b) }
+
+// EchoResponse answers an Echo Request
+type EchoResponse struct{}
+
+// MessageType implements Message
+func (m *EchoResponse) MessageType() MessageType { return MessageTypeEchoResponse }
+
+// ControlPacket implements Message
+func (m *EchoResponse) ControlPacket() (ControlPacket, error) {
+	return encodeAttributes(m.MessageType())
+}
+
+// DecodeControlPacket implements Message
+func (m *EchoResponse) DecodeControlPacket(p ControlPacket) error {
+	err := checkMessageType(p, m.MessageType())
+	if err != nil {
+		return err
+	}
+	return decodeNoAttributes(p)
+}
+
+// MarshalBinary implements Message
+func (m *EchoResponse) MarshalBinary() ([]byte, error) { return marshalMessage(m) }
+
+// UnmarshalBinary implements Message
+func (m *EchoResponse) UnmarshalBinary(b []byte) error { return unmarshalMessage(m, b) }
@@ -0,0 +1,164 @@
+package sstp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	var nonce, certHash, mac [32]byte
+	for i := range nonce {
+		nonce[i] = byte(i)
+		certHash[i] = byte(0x40 + i)
+		mac[i] = byte(0x80 + i)
+	}
+	tests := []struct {
+		message Message
+		packet  string // Expected encoding, if checked
+	}{
+		{&CallConnectRequest{ProtocolID: EncapsulatedProtocolIDPPP}, "1001000e" + "00010001" + "00010006" + "0001"},
+		{&CallConnectAck{CryptoBindingReq{HashProtocols: HashProtocolSHA1 | HashProtocolSHA256, Nonce: nonce}},
+			"10010030" + "00020001" + "00040028" + "00000003" + hex.EncodeToString(nonce[:])},
+		{&CallConnectNak{StatusInfos: []StatusInfo{{AttributeIDEncapsulatedProtocolID, AttributeStatusValueNotSupported, []byte{0, 1}}}},
+			"10010016" + "00030001" + "0002000e" + "00000001" + "00000004" + "0001"},
+		{&CallConnected{CryptoBinding{HashProtocol: HashProtocolSHA256, Nonce: nonce, CertHash: certHash, CompoundMAC: mac}},
+			"10010070" + "00040001" + "00030068" + "00000002" + hex.EncodeToString(nonce[:]) + hex.EncodeToString(certHash[:]) + hex.EncodeToString(mac[:])},
+		{&CallAbort{StatusInfos: []StatusInfo{}}, "10010008" + "00050000"},
+		{&CallAbort{StatusInfos: []StatusInfo{{0, AttributeStatusInvalidFrameReceived, []byte{}}}},
+			"10010014" + "00050001" + "0002000c" + "00000000" + "00000007"},
+		{&CallDisconnect{StatusInfos: []StatusInfo{}}, "10010008" + "00060000"},
+		{&CallDisconnect{StatusInfos: []StatusInfo{
+			{0, AttributeStatusNegotiationTimeout, []byte{}},
+			{AttributeIDCryptoBinding, AttributeStatusInvalidFrameReceived, []byte{}},
+		}}, ""},
+		{&CallDisconnectAck{}, "10010008" + "00070000"},
+		{&EchoRequest{}, "10010008" + "00080000"},
+		{&EchoResponse{}, "10010008" + "00090000"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.message.MessageType().String(), func(t *testing.T) {
+			b, err := tt.message.MarshalBinary()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.packet != "" && !bytes.Equal(b, mustHex(t, tt.packet)) {
+				t.Errorf("MarshalBinary() = %x, want %s", b, tt.packet)
+			}
+
+			var p ControlPacket
+			err = p.UnmarshalBinary(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			decoded, err := p.Message()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(decoded, tt.message) {
+				t.Errorf("Message() = %+v, want %+v", decoded, tt.message)
+			}
+
+			// Unmarshaling directly into the message type gives the same result
+			direct := reflect.New(reflect.TypeOf(tt.message).Elem()).Interface().(Message)
+			err = direct.UnmarshalBinary(b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(direct, tt.message) {
+				t.Errorf("UnmarshalBinary() = %+v, want %+v", direct, tt.message)
+			}
+		})
+	}
+}
+
+func TestMessageTypeErrors(t *testing.T) {
+	_, err := ControlPacket{MessageType: 0x20}.Message()
+	var typeErr *MessageTypeError
+	if !errors.As(err, &typeErr) || typeErr.Expected != 0 || typeErr.Actual != 0x20 {
+		t.Errorf("Message() of an unknown type error = %v, want a MessageTypeError", err)
+	}
+
+	packet, err := (&EchoRequest{}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = (&EchoResponse{}).UnmarshalBinary(packet)
+	if !errors.As(err, &typeErr) || typeErr.Expected != MessageTypeEchoResponse || typeErr.Actual != MessageTypeEchoRequest {
+		t.Errorf("UnmarshalBinary() of the wrong type error = %v, want a MessageTypeError", err)
+	}
+}
+
+func TestAttributeErrors(t *testing.T) {
+	protocol := Attribute{AttributeIDEncapsulatedProtocolID, []byte{0, 1}}
+	statusInfo := Attribute{AttributeIDStatusInfo, make([]byte, statusInfoMinLength)}
+	tests := []struct {
+		name        string
+		packet      ControlPacket
+		attributeID AttributeID
+		status      AttributeStatus
+	}{
+		{"missing attribute", ControlPacket{MessageTypeCallConnectRequest, nil},
+			AttributeIDEncapsulatedProtocolID, AttributeStatusRequiredAttributeMissing},
+		{"duplicate attribute", ControlPacket{MessageTypeCallConnectRequest, []Attribute{protocol, protocol}},
+			AttributeIDEncapsulatedProtocolID, AttributeStatusDuplicateAttribute},
+		{"attribute not allowed", ControlPacket{MessageTypeCallConnectRequest, []Attribute{statusInfo}},
+			AttributeIDStatusInfo, AttributeStatusAttribNotSupportedInMsg},
+		{"unknown attribute", ControlPacket{MessageTypeCallConnectRequest, []Attribute{{0x10, nil}}},
+			0x10, AttributeStatusUnrecognizedAttribute},
+		{"reserved attribute", ControlPacket{MessageTypeEchoRequest, []Attribute{{0, nil}}},
+			0, AttributeStatusUnrecognizedAttribute},
+		{"attribute in echo", ControlPacket{MessageTypeEchoRequest, []Attribute{protocol}},
+			AttributeIDEncapsulatedProtocolID, AttributeStatusAttribNotSupportedInMsg},
+		{"non-status attribute in abort", ControlPacket{MessageTypeCallAbort, []Attribute{protocol}},
+			AttributeIDEncapsulatedProtocolID, AttributeStatusAttribNotSupportedInMsg},
+		{"short protocol value", ControlPacket{MessageTypeCallConnectRequest, []Attribute{{AttributeIDEncapsulatedProtocolID, []byte{1}}}},
+			AttributeIDEncapsulatedProtocolID, AttributeStatusInvalidAttribValueLength},
+		{"short status info value", ControlPacket{MessageTypeCallDisconnect, []Attribute{{AttributeIDStatusInfo, make([]byte, 7)}}},
+			AttributeIDStatusInfo, AttributeStatusInvalidAttribValueLength},
+		{"short crypto binding request", ControlPacket{MessageTypeCallConnectAck, []Attribute{{AttributeIDCryptoBindingReq, make([]byte, 35)}}},
+			AttributeIDCryptoBindingReq, AttributeStatusInvalidAttribValueLength},
+		{"long crypto binding", ControlPacket{MessageTypeCallConnected, []Attribute{{AttributeIDCryptoBinding, make([]byte, 101)}}},
+			AttributeIDCryptoBinding, AttributeStatusInvalidAttribValueLength},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := tt.packet.Message()
+			var attributeErr *AttributeError
+			if !errors.As(err, &attributeErr) {
+				t.Fatalf("Message() error = %v, want an AttributeError", err)
+			}
+			want := AttributeError{tt.packet.MessageType, tt.attributeID, tt.status}
+			if *attributeErr != want {
+				t.Errorf("Message() error = %+v, want %+v", *attributeErr, want)
+			}
+			statusInfo := attributeErr.StatusInfo()
+			if statusInfo.AttribID != tt.attributeID || statusInfo.Status != tt.status {
+				t.Errorf("StatusInfo() = %+v", statusInfo)
+			}
+		})
+	}
+}
+
+func TestAttributeUnmarshalExact(t *testing.T) {
+	var a Attribute
+	err := a.UnmarshalBinary(mustHex(t, "00010006"+"0001"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if a.ID != AttributeIDEncapsulatedProtocolID || !bytes.Equal(a.Value, []byte{0, 1}) {
+		t.Errorf("UnmarshalBinary() = %+v", a)
+	}
+
+	var lengthErr *LengthError
+	err = a.UnmarshalBinary(mustHex(t, "00010006"+"000100"))
+	if !errors.As(err, &lengthErr) {
+		t.Errorf("UnmarshalBinary() with trailing bytes error = %v, want a LengthError", err)
+	}
+	err = a.UnmarshalBinary(mustHex(t, "0001"))
+	if !errors.As(err, &lengthErr) {
+		t.Errorf("UnmarshalBinary() of a truncated header error = %v, want a LengthError", err)
+	}
+}
@@ -0,0 +1,229 @@
+package sstp
+
+import (
+	"encoding/binary"
+)
+
+// Header is the header common to all SSTP packets
+type Header struct {
+	MajorVersion uint8
+	MinorVersion uint8
+	C            bool // Set for control packets
+	Length       uint16
+}
+
+// MarshalBinary encodes the header
+func (h Header) MarshalBinary() ([]byte, error) {
+	if h.Length > MaxPacketLength {
+		return nil, &LengthError{"packet", int(h.Length), MaxPacketLength}
+	}
+	b := make([]byte, HeaderLength)
+	b[0] = (h.MajorVersion << 4) + (h.MinorVersion & 0xf)
+	if h.C {
+		b[1] = 1
+	}
+	binary.BigEndian.PutUint16(b[2:4], h.Length)
+	return b, nil
+}
+
+// UnmarshalBinary decodes and validates a header, from the start of b
+func (h *Header) UnmarshalBinary(b []byte) error {
+	if len(b) < HeaderLength {
+		return &LengthError{"header", HeaderLength, len(b)}
+	}
+
+	majVer := b[0] >> 4
+	minVer := b[0] & 0xf
+	if majVer != MajorVersion || minVer != MinorVersion {
+		return ErrVersion
+	}
+	// Only the lowest bit (C) is defined, the rest are reserved
+	if b[1]&0xfe != 0 {
+		return ErrReserved
+	}
+	// The length is 12 bits, the top 4 bits are reserved
+	if b[2]&0xf0 != 0 {
+		return ErrReserved
+	}
+
+	h.MajorVersion = majVer
+	h.MinorVersion = minVer
+	h.C = b[1] == 1
+	h.Length = binary.BigEndian.Uint16(b[2:4])
+
+	if h.Length <= HeaderLength || (h.C && h.Length < ControlHeaderLength) {
+		return &LengthError{"packet", int(h.Length), len(b)}
+	}
+	return nil
+}
+
+func newHeader(isControl bool, length int) (Header, error) {
+	if length > MaxPacketLength {
+		return Header{}, &LengthError{"packet", length, MaxPacketLength}
+	}
+	return Header{MajorVersion, MinorVersion, isControl, uint16(length)}, nil
+}
+
+// Attribute is an attribute of a control packet, with an encoded value
+type Attribute struct {
+	ID    AttributeID
+	Value []byte
+}
+
+// MarshalBinary encodes the attribute, including the attribute header
+func (a Attribute) MarshalBinary() ([]byte, error) {
+	length := AttributeHeaderLength + len(a.Value)
+	if length > MaxPacketLength-ControlHeaderLength {
+		return nil, &LengthError{a.ID.String() + " attribute", length, MaxPacketLength - ControlHeaderLength}
+	}
+	b := make([]byte, length)
+	// Don't set 0, should be reserved
+	b[1] = uint8(a.ID)
+	binary.BigEndian.PutUint16(b[2:4], uint16(length))
+	copy(b[4:], a.Value)
+	return b, nil
+}
+
+// UnmarshalBinary decodes an attribute, which must fill b exactly.
+// The value refers to the same memory as b.
+func (a *Attribute) UnmarshalBinary(b []byte) error {
+	n, err := a.unmarshal(b)
+	if err != nil {
+		return err
+	}
+	if n != len(b) {
+		return &LengthError{a.ID.String() + " attribute", n, len(b)}
+	}
+	return nil
+}
+
+// unmarshal decodes an attribute from the start of b, returning the number of bytes used
+func (a *Attribute) unmarshal(b []byte) (int, error) {
+	if len(b) < AttributeHeaderLength {
+		return 0, &LengthError{"attribute header", AttributeHeaderLength, len(b)}
+	}
+	// ignore Reserved byte
+	id := AttributeID(b[1])
+	length := int(binary.BigEndian.Uint16(b[2:4]))
+	if length < AttributeHeaderLength || length > len(b) {
+		return 0, &LengthError{id.String() + " attribute", length, len(b)}
+	}
+	a.ID = id
+	a.Value = b[AttributeHeaderLength:length]
+	return length, nil
+}
+
+// ControlPacket is a SSTP control packet, with encoded attributes
+type ControlPacket struct {
+	MessageType MessageType
+	Attributes  []Attribute
+}
+
+// MarshalBinary encodes the control packet, including the SSTP header
+func (p ControlPacket) MarshalBinary() ([]byte, error) {
+	encodedAttributes := make([][]byte, len(p.Attributes))
+	length := ControlHeaderLength
+	for i, v := range p.Attributes {
+		encoded, err := v.MarshalBinary()
+		if err != nil {
+			return nil, err
+		}
+		encodedAttributes[i] = encoded
+		length += len(encoded)
+	}
+
+	header, err := newHeader(true, length)
+	if err != nil {
+		return nil, err
+	}
+	b, err := header.MarshalBinary()
+	if err != nil {
+		return nil, err
+	}
+	b = append(b, 0, 0, 0, 0)
+	binary.BigEndian.PutUint16(b[4:6], uint16(p.MessageType))
+	binary.BigEndian.PutUint16(b[6:8], uint16(len(p.Attributes)))
+	for _, v := range encodedAttributes {
+		b = append(b, v...)
+	}
+	return b, nil
+}
+
+// UnmarshalBinary decodes a control packet, including the SSTP header, which must fill b exactly.
+// The attribute values refer to the same memory as b.
+func (p *ControlPacket) UnmarshalBinary(b []byte) error {
+	var header Header
+	err := header.UnmarshalBinary(b)
+	if err != nil {
+		return err
+	}
+	if !header.C {
+		return ErrNotControl
+	}
+	if int(header.Length) != len(b) {
+		return &LengthError{"packet", int(header.Length), len(b)}
+	}
+
+	messageType := MessageType(binary.BigEndian.Uint16(b[4:6]))
+	numAttributes := int(binary.BigEndian.Uint16(b[6:8]))
+	// Each attribute is at least 4 bytes, so don't allocate more than can fit
+	if numAttributes*AttributeHeaderLength > len(b)-ControlHeaderLength {
+		return &LengthError{"attributes", numAttributes * AttributeHeaderLength, len(b) - ControlHeaderLength}
+	}
+
+	attributes := make([]Attribute, numAttributes)
+	consumedBytes := ControlHeaderLength
+	for i := range attributes {
+		n, err := attributes[i].unmarshal(b[consumedBytes:])
+		if err != nil {
+			return err
+		}
+		consumedBytes += n
+	}
+	if consumedBytes != len(b) {
+		return &LengthError{"attributes", consumedBytes - ControlHeaderLength, len(b) - ControlHeaderLength}
+	}
+
+	p.MessageType = messageType
+	p.Attributes = attributes
+	return nil
+}
+
+// DataPacket is a SSTP data packet, carrying a packet of the encapsulated protocol
+type DataPacket struct {
+	Data []byte
+}
+
+// MarshalBinary encodes the data packet, including the SSTP header
+func (p DataPacket) MarshalBinary() ([]byte, error) {
+	return AppendDataPacket(make([]byte, 0, HeaderLength+len(p.Data)), p.Data)
+}
+
+// UnmarshalBinary decodes a data packet, including the SSTP header, which must fill b exactly.
+// The data refers to the same memory as b.
+func (p *DataPacket) UnmarshalBinary(b []byte) error {
+	var header Header
+	err := header.UnmarshalBinary(b)
+	if err != nil {
+		return err
+	}
+	if header.C {
+		return ErrNotData
+	}
+	if int(header.Length) != len(b) {
+		return &LengthError{"packet", int(header.Length), len(b)}
+	}
+	p.Data = b[HeaderLength:]
+	return nil
+}
+
+// AppendDataPacket appends a data packet containing data to b, avoiding the allocations of DataPacket.MarshalBinary
+func AppendDataPacket(b []byte, data []byte) ([]byte, error) {
+	length := HeaderLength + len(data)
+	if length > MaxPacketLength {
+		return nil, &LengthError{"packet", length, MaxPacketLength}
+	}
+	b = append(b, (MajorVersion<<4)+MinorVersion, 0, 0, 0)
+	binary.BigEndian.PutUint16(b[len(b)-2:], uint16(length))
+	return append(b, data...), nil
+}
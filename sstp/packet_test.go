@@ -0,0 +1,176 @@
+package sstp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"testing"
+)
+
+func mustHex(tb testing.TB, s string) []byte {
+	tb.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return b
+}
+
+func TestHeaderUnmarshal(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet string
+		want   Header
+		err    error
+	}{
+		{"data", "10000008", Header{1, 0, false, 8}, nil},
+		{"control", "1001000c", Header{1, 0, true, 12}, nil},
+		{"max length", "10010fff", Header{1, 0, true, MaxPacketLength}, nil},
+		{"version 2.0", "20000008", Header{}, ErrVersion},
+		{"version 1.1", "11000008", Header{}, ErrVersion},
+		{"reserved flag bits", "10020008", Header{}, ErrReserved},
+		{"reserved length bits", "10001008", Header{}, ErrReserved},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h Header
+			err := h.UnmarshalBinary(mustHex(t, tt.packet))
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("UnmarshalBinary() error = %v, want %v", err, tt.err)
+			}
+			if err == nil && h != tt.want {
+				t.Errorf("UnmarshalBinary() = %+v, want %+v", h, tt.want)
+			}
+		})
+	}
+}
+
+func TestHeaderLengthErrors(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet string
+	}{
+		{"truncated header", "1000"},
+		{"empty data packet", "10000004"},
+		{"data shorter than header", "10000002"},
+		{"control shorter than control header", "10010007"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var h Header
+			var lengthErr *LengthError
+			err := h.UnmarshalBinary(mustHex(t, tt.packet))
+			if !errors.As(err, &lengthErr) {
+				t.Errorf("UnmarshalBinary() error = %v, want a LengthError", err)
+			}
+		})
+	}
+}
+
+func TestControlPacketRoundTrip(t *testing.T) {
+	p := ControlPacket{MessageTypeCallConnectRequest, []Attribute{{AttributeIDEncapsulatedProtocolID, []byte{0, 1}}}}
+	want := mustHex(t, "1001000e"+"0001"+"0001"+"00010006"+"0001")
+
+	b, err := p.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("MarshalBinary() = %x, want %x", b, want)
+	}
+
+	var decoded ControlPacket
+	err = decoded.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if decoded.MessageType != p.MessageType || len(decoded.Attributes) != 1 ||
+		decoded.Attributes[0].ID != AttributeIDEncapsulatedProtocolID || !bytes.Equal(decoded.Attributes[0].Value, []byte{0, 1}) {
+		t.Errorf("UnmarshalBinary() = %+v, want %+v", decoded, p)
+	}
+}
+
+func TestControlPacketMalformed(t *testing.T) {
+	tests := []struct {
+		name   string
+		packet string
+		err    error // nil for a LengthError
+	}{
+		{"data packet", "10000008" + "00080000", ErrNotControl},
+		{"length longer than packet", "10010010" + "00080000", nil},
+		{"length shorter than packet", "10010008" + "00080000" + "00", nil},
+		{"too many attributes", "10010008" + "00080001", nil},
+		{"attribute count too high", "1001000c" + "00010002" + "00010004", nil},
+		{"attribute count too low", "10010010" + "00010001" + "00010004" + "00010004", nil},
+		{"attribute length too short", "1001000c" + "00010001" + "00010002", nil},
+		{"attribute length past end", "1001000e" + "00010001" + "00010008" + "0001", nil},
+		{"truncated attribute header", "1001000e" + "00010002" + "00010004" + "0001", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var p ControlPacket
+			err := p.UnmarshalBinary(mustHex(t, tt.packet))
+			if tt.err != nil {
+				if !errors.Is(err, tt.err) {
+					t.Errorf("UnmarshalBinary() error = %v, want %v", err, tt.err)
+				}
+				return
+			}
+			var lengthErr *LengthError
+			if !errors.As(err, &lengthErr) {
+				t.Errorf("UnmarshalBinary() error = %v, want a LengthError", err)
+			}
+		})
+	}
+}
+
+func TestControlPacketTooLong(t *testing.T) {
+	p := ControlPacket{MessageTypeCallAbort, []Attribute{{AttributeIDStatusInfo, make([]byte, MaxPacketLength)}}}
+	var lengthErr *LengthError
+	_, err := p.MarshalBinary()
+	if !errors.As(err, &lengthErr) {
+		t.Errorf("MarshalBinary() error = %v, want a LengthError", err)
+	}
+
+	// Each attribute fits, but not all of them together
+	value := make([]byte, MaxPacketLength/2)
+	p.Attributes = []Attribute{{AttributeIDStatusInfo, value}, {AttributeIDStatusInfo, value}}
+	_, err = p.MarshalBinary()
+	if !errors.As(err, &lengthErr) {
+		t.Errorf("MarshalBinary() error = %v, want a LengthError", err)
+	}
+}
+
+func TestDataPacket(t *testing.T) {
+	frame := []byte{0xff, 0x03, 0xc0, 0x21}
+	want := mustHex(t, "10000008ff03c021")
+	b, err := DataPacket{frame}.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, want) {
+		t.Fatalf("MarshalBinary() = %x, want %x", b, want)
+	}
+	var p DataPacket
+	err = p.UnmarshalBinary(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(p.Data, frame) {
+		t.Errorf("UnmarshalBinary() = %x, want %x", p.Data, frame)
+	}
+
+	err = p.UnmarshalBinary(mustHex(t, "1001000c"+"00080000"+"00000000"))
+	if !errors.Is(err, ErrNotData) {
+		t.Errorf("UnmarshalBinary() of a control packet error = %v, want %v", err, ErrNotData)
+	}
+	var lengthErr *LengthError
+	err = p.UnmarshalBinary(want[:6])
+	if !errors.As(err, &lengthErr) {
+		t.Errorf("UnmarshalBinary() of a truncated packet error = %v, want a LengthError", err)
+	}
+	_, err = AppendDataPacket(nil, make([]byte, MaxPacketLength))
+	if !errors.As(err, &lengthErr) {
+		t.Errorf("AppendDataPacket() of a too long frame error = %v, want a LengthError", err)
+	}
+}
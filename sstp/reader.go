@@ -0,0 +1,60 @@
+package sstp
+
+import (
+	"bufio"
+	"io"
+	"sync"
+)
+
+// Reader reads SSTP packets from a stream, regardless of how they are split across reads
+type Reader struct {
+	reader *bufio.Reader
+	pool   sync.Pool
+}
+
+// NewReader creates a Reader reading from r
+func NewReader(r io.Reader) *Reader {
+	return &Reader{
+		reader: bufio.NewReaderSize(r, MaxPacketLength),
+		pool: sync.Pool{
+			New: func() interface{} {
+				buf := make([]byte, MaxPacketLength)
+				return &buf
+			},
+		},
+	}
+}
+
+// ReadPacket reads the next packet, including the SSTP header.
+// The returned packet should be passed to Release once it is no longer used.
+func (r *Reader) ReadPacket() (Header, []byte, error) {
+	var header Header
+	buf := r.pool.Get().(*[]byte)
+
+	_, err := io.ReadFull(r.reader, (*buf)[:HeaderLength])
+	if err == nil {
+		err = header.UnmarshalBinary((*buf)[:HeaderLength])
+	}
+	if err != nil {
+		r.pool.Put(buf)
+		return header, nil, err
+	}
+
+	packet := (*buf)[:header.Length]
+	_, err = io.ReadFull(r.reader, packet[HeaderLength:])
+	if err != nil {
+		r.pool.Put(buf)
+		if err == io.EOF {
+			// The header was read, so the packet is truncated
+			err = io.ErrUnexpectedEOF
+		}
+		return header, nil, err
+	}
+	return header, packet, nil
+}
+
+// Release returns a packet from ReadPacket to be reused for another packet
+func (r *Reader) Release(packet []byte) {
+	packet = packet[:cap(packet)]
+	r.pool.Put(&packet)
+}
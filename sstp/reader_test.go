@@ -0,0 +1,109 @@
+package sstp
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"testing/iotest"
+)
+
+func TestReaderSplitReads(t *testing.T) {
+	var stream []byte
+	var want [][]byte
+	for _, frame := range [][]byte{{0xff, 0x03, 0x00, 0x21}, {0x7e}, bytes.Repeat([]byte{0x45}, 300)} {
+		packet, err := AppendDataPacket(nil, frame)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stream = append(stream, packet...)
+		want = append(want, packet)
+	}
+	control, err := (&EchoRequest{}).MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream = append(stream, control...)
+	want = append(want, control)
+
+	tests := []struct {
+		name   string
+		reader func(io.Reader) io.Reader
+	}{
+		{"one byte", iotest.OneByteReader},
+		{"half", iotest.HalfReader},
+		{"data error", iotest.DataErrReader},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(tt.reader(bytes.NewReader(stream)))
+			for i, w := range want {
+				header, packet, err := r.ReadPacket()
+				if err != nil {
+					t.Fatalf("Packet %d: %v", i, err)
+				}
+				if !bytes.Equal(packet, w) {
+					t.Errorf("Packet %d = %x, want %x", i, packet, w)
+				}
+				if header.C != (i == len(want)-1) {
+					t.Errorf("Packet %d: C = %t", i, header.C)
+				}
+				r.Release(packet)
+			}
+			if _, _, err := r.ReadPacket(); err != io.EOF {
+				t.Errorf("ReadPacket() at end of stream error = %v, want EOF", err)
+			}
+		})
+	}
+}
+
+func TestReaderTruncated(t *testing.T) {
+	packet, err := AppendDataPacket(nil, []byte{0xff, 0x03, 0x00, 0x21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name   string
+		stream []byte
+		err    error
+	}{
+		{"empty", nil, io.EOF},
+		{"header", packet[:2], io.ErrUnexpectedEOF},
+		{"body", packet[:len(packet)-1], io.ErrUnexpectedEOF},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(iotest.OneByteReader(bytes.NewReader(tt.stream)))
+			_, _, err := r.ReadPacket()
+			if !errors.Is(err, tt.err) {
+				t.Errorf("ReadPacket() error = %v, want %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestReaderReleaseReuses(t *testing.T) {
+	packet, err := AppendDataPacket(nil, []byte{0xff, 0x03, 0x00, 0x21})
+	if err != nil {
+		t.Fatal(err)
+	}
+	const packets = 10
+	r := NewReader(bytes.NewReader(bytes.Repeat(packet, packets)))
+	// sync.Pool may drop a buffer, so only expect it to be reused most of the time
+	var previous *byte
+	reused := 0
+	for i := 0; i < packets; i++ {
+		_, p, err := r.ReadPacket()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if &p[0] == previous {
+			reused++
+		}
+		previous = &p[0]
+		r.Release(p)
+	}
+	if reused == 0 {
+		t.Error("Released buffers are never reused")
+	}
+}
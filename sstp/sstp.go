@@ -0,0 +1,195 @@
+// Package sstp encodes and decodes Secure Socket Tunneling Protocol (MS-SSTP) packets.
+//
+// Only version 1.0 of the protocol is defined, and packets with any other version are rejected.
+package sstp
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"fmt"
+	"hash"
+)
+
+// The protocol version implemented by this package
+const (
+	MajorVersion = 1
+	MinorVersion = 0
+)
+
+// Lengths of the fixed parts of SSTP packets
+const (
+	HeaderLength          = 4
+	ControlHeaderLength   = 8 // Including the SSTP header
+	AttributeHeaderLength = 4
+	// MaxPacketLength is the largest packet that fits in the 12 bit length field
+	MaxPacketLength = 0x0fff
+)
+
+// MessageType is the type of message this packet is
+type MessageType uint16
+
+// Constants for MessageType values
+const (
+	MessageTypeCallConnectRequest MessageType = 1
+	MessageTypeCallConnectAck     MessageType = 2
+	MessageTypeCallConnectNak     MessageType = 3
+	MessageTypeCallConnected      MessageType = 4
+	MessageTypeCallAbort          MessageType = 5
+	MessageTypeCallDisconnect     MessageType = 6
+	MessageTypeCallDisconnectAck  MessageType = 7
+	MessageTypeEchoRequest        MessageType = 8
+	MessageTypeEchoResponse       MessageType = 9
+)
+
+func (k MessageType) String() string {
+	switch k {
+	case MessageTypeCallConnectRequest:
+		return "CallConnectRequest"
+	case MessageTypeCallConnectAck:
+		return "CallConnectAck"
+	case MessageTypeCallConnectNak:
+		return "CallConnectNak"
+	case MessageTypeCallConnected:
+		return "CallConnected"
+	case MessageTypeCallAbort:
+		return "CallAbort"
+	case MessageTypeCallDisconnect:
+		return "CallDisconnect"
+	case MessageTypeCallDisconnectAck:
+		return "CallDisconnectAck"
+	case MessageTypeEchoRequest:
+		return "EchoRequest"
+	case MessageTypeEchoResponse:
+		return "EchoResponse"
+	default:
+		return fmt.Sprintf("Unknown(%d)", k)
+	}
+}
+
+// AttributeID is the type of attribute this attribute is
+type AttributeID uint8
+
+// Constants for AttributeID values
+const (
+	AttributeIDEncapsulatedProtocolID AttributeID = 1
+	AttributeIDStatusInfo             AttributeID = 2
+	AttributeIDCryptoBinding          AttributeID = 3
+	AttributeIDCryptoBindingReq       AttributeID = 4
+)
+
+func (k AttributeID) String() string {
+	switch k {
+	case AttributeIDEncapsulatedProtocolID:
+		return "EncapsulatedProtocolID"
+	case AttributeIDStatusInfo:
+		return "StatusInfo"
+	case AttributeIDCryptoBinding:
+		return "CryptoBinding"
+	case AttributeIDCryptoBindingReq:
+		return "CryptoBindingReq"
+	default:
+		return fmt.Sprintf("Unknown(%d)", k)
+	}
+}
+
+// AttributeStatus is the status of an attribute, sent in StatusInfo attributes
+type AttributeStatus uint32
+
+// Constants for AttributeStatus values
+const (
+	AttributeStatusNoError                     AttributeStatus = 0x00
+	AttributeStatusDuplicateAttribute          AttributeStatus = 0x01
+	AttributeStatusUnrecognizedAttribute       AttributeStatus = 0x02
+	AttributeStatusInvalidAttribValueLength    AttributeStatus = 0x03
+	AttributeStatusValueNotSupported           AttributeStatus = 0x04
+	AttributeStatusUnacceptedFrameReceived     AttributeStatus = 0x05
+	AttributeStatusRetryCountExceeded          AttributeStatus = 0x06
+	AttributeStatusInvalidFrameReceived        AttributeStatus = 0x07
+	AttributeStatusNegotiationTimeout          AttributeStatus = 0x08
+	AttributeStatusAttribNotSupportedInMsg     AttributeStatus = 0x09
+	AttributeStatusRequiredAttributeMissing    AttributeStatus = 0x0A
+	AttributeStatusStatusInfoNotSupportedInMsg AttributeStatus = 0x0B
+)
+
+func (k AttributeStatus) String() string {
+	switch k {
+	case AttributeStatusNoError:
+		return "NoError"
+	case AttributeStatusDuplicateAttribute:
+		return "DuplicateAttribute"
+	case AttributeStatusUnrecognizedAttribute:
+		return "UnrecognizedAttribute"
+	case AttributeStatusInvalidAttribValueLength:
+		return "InvalidAttribValueLength"
+	case AttributeStatusValueNotSupported:
+		return "ValueNotSupported"
+	case AttributeStatusUnacceptedFrameReceived:
+		return "UnacceptedFrameReceived"
+	case AttributeStatusRetryCountExceeded:
+		return "RetryCountExceeded"
+	case AttributeStatusInvalidFrameReceived:
+		return "InvalidFrameReceived"
+	case AttributeStatusNegotiationTimeout:
+		return "NegotiationTimeout"
+	case AttributeStatusAttribNotSupportedInMsg:
+		return "AttribNotSupportedInMsg"
+	case AttributeStatusRequiredAttributeMissing:
+		return "RequiredAttributeMissing"
+	case AttributeStatusStatusInfoNotSupportedInMsg:
+		return "StatusInfoNotSupportedInMsg"
+	default:
+		return fmt.Sprintf("Unknown(%d)", k)
+	}
+}
+
+// EncapsulatedProtocolID is the protocol carried in SSTP data packets
+type EncapsulatedProtocolID uint16
+
+// Constants for EncapsulatedProtocolID values
+const (
+	EncapsulatedProtocolIDPPP EncapsulatedProtocolID = 1
+)
+
+func (k EncapsulatedProtocolID) String() string {
+	switch k {
+	case EncapsulatedProtocolIDPPP:
+		return "PPP"
+	default:
+		return fmt.Sprintf("Unknown(%d)", k)
+	}
+}
+
+// HashProtocol is a hash protocol used for crypto binding.
+// In CryptoBindingReq it is a bitmask of the supported protocols, in CryptoBinding it is a single protocol.
+type HashProtocol uint8
+
+// Constants for HashProtocol values
+const (
+	HashProtocolSHA1   HashProtocol = 1
+	HashProtocolSHA256 HashProtocol = 2
+)
+
+func (k HashProtocol) String() string {
+	switch k {
+	case HashProtocolSHA1:
+		return "SHA1"
+	case HashProtocolSHA256:
+		return "SHA256"
+	case HashProtocolSHA1 | HashProtocolSHA256:
+		return "SHA1|SHA256"
+	default:
+		return fmt.Sprintf("Unknown(%d)", k)
+	}
+}
+
+// Hash returns the hash function of a single hash protocol, or nil if it is not supported
+func (k HashProtocol) Hash() func() hash.Hash {
+	switch k {
+	case HashProtocolSHA1:
+		return sha1.New
+	case HashProtocolSHA256:
+		return sha256.New
+	default:
+		return nil
+	}
+}